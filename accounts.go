@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/honesea/go-chirpy/internal/database"
+)
+
+const (
+	defaultDeletionGracePeriod = 30 * 24 * time.Hour
+	purgeInterval              = time.Hour
+)
+
+// deleteUser soft-deletes the caller's account. It can be restored until
+// the grace period is up, then the purge removes it for good.
+func (cfg *apiConfig) deleteUser(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, err := cfg.db.DeleteUser(userId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, 404, "User doesn't exist")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem deleting the user")
+		return
+	}
+
+	response := struct {
+		database.User
+		PurgeAt time.Time `json:"purge_at"`
+	}{
+		User:    user,
+		PurgeAt: user.DeletedAt.Add(cfg.deletionGracePeriod),
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+// restoreUser undoes deleteUser. The account's tokens were revoked, so it
+// takes the account's credentials rather than a token.
+func (cfg *apiConfig) restoreUser(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		respondWithError(w, 500, "Something went wrong")
+		return
+	}
+
+	user, err := cfg.db.RestoreUser(params.Email, params.Password)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	respondWithJSON(w, 200, user)
+}
+
+// purgeDeletedUsers removes accounts whose grace period is up every
+// interval until ctx is done.
+func purgeDeletedUsers(ctx context.Context, db database.Store, grace time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := db.PurgeDeletedUsers(time.Now().Add(-grace))
+		if err != nil {
+			log.Printf("could not purge deleted users: %v", err)
+		} else if purged > 0 {
+			log.Printf("purged %d deleted users", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
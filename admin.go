@@ -6,16 +6,23 @@ import (
 )
 
 func (cfg *apiConfig) adminMetrics(w http.ResponseWriter, r *http.Request) {
+	sessions, err := cfg.db.CountLiveSessions()
+	if err != nil {
+		respondWithError(w, 500, "There was a problem counting sessions")
+		return
+	}
+
 	html := fmt.Sprintf(`
 		<html>
 
 		<body>
 			<h1>Welcome, Chirpy Admin</h1>
 			<p>Chirpy has been visited %d times!</p>
+			<p>There are %d live sessions.</p>
 		</body>
 
 		</html>
-	`, cfg.fileserverHits)
+	`, cfg.fileserverHits, sessions)
 
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
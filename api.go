@@ -2,10 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/honesea/go-chirpy/internal/database"
@@ -13,9 +17,18 @@ import (
 
 type apiConfig struct {
 	fileserverHits int
-	db             database.DB
-	jwtSecret      string
+	db             database.Store
 	polkaApiKey    string
+	// keys signs and verifies access and refresh tokens
+	keys            *keyring
+	accessLifetime  tokenLifetime
+	refreshLifetime tokenLifetime
+
+	// deletionGracePeriod is how long deleted accounts wait to be purged
+	deletionGracePeriod time.Duration
+	exports             *exports
+	// exportSecret signs export download links
+	exportSecret string
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -35,9 +48,15 @@ func (cfg *apiConfig) healthz(w http.ResponseWriter, r *http.Request) {
 }
 
 func (cfg *apiConfig) metrics(w http.ResponseWriter, r *http.Request) {
+	sessions, err := cfg.db.CountLiveSessions()
+	if err != nil {
+		respondWithError(w, 500, "There was a problem counting sessions")
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Write([]byte(fmt.Sprintf("Hits: %v", cfg.fileserverHits)))
+	w.Write([]byte(fmt.Sprintf("Hits: %v\nLive sessions: %v", cfg.fileserverHits, sessions)))
 }
 
 func (cfg *apiConfig) reset(w http.ResponseWriter, r *http.Request) {
@@ -54,19 +73,105 @@ func (cfg *apiConfig) listChirps(w http.ResponseWriter, r *http.Request) {
 		authorID = 0
 	}
 
+	// sort is asc or desc by ID, or a field with an optional direction
+	// such as created_at or created_at:desc
 	sortStr := r.URL.Query().Get("sort")
+	sortBy, direction, _ := strings.Cut(sortStr, ":")
+	if sortBy == "asc" || sortBy == "desc" {
+		sortBy, direction = database.SortByID, sortBy
+	}
+	if sortBy != database.SortByCreatedAt {
+		sortBy = database.SortByID
+	}
 	sortDesc := false
-	if sortStr == "desc" {
+	if direction == "desc" {
 		sortDesc = true
 	}
 
-	chirpList, err := cfg.db.ListChirps(authorID, sortDesc)
+	// IDs only ever increase, so clients can page with after_id/before_id
+	afterID, _ := strconv.Atoi(r.URL.Query().Get("after_id"))
+	beforeID, _ := strconv.Atoi(r.URL.Query().Get("before_id"))
+
+	limit, cursor, paginated, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	page, err := cfg.db.ListChirps(database.ChirpQuery{
+		AuthorID: authorID,
+		SortBy:   sortBy,
+		SortDesc: sortDesc,
+		AfterID:  afterID,
+		BeforeID: beforeID,
+		Limit:    limit,
+		Cursor:   cursor,
+	})
+	if errors.Is(err, database.ErrInvalidCursor) {
+		respondWithError(w, 400, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving chirps")
+		return
+	}
+
+	response, err := cfg.pageResponse(cfg.viewer(r), page)
 	if err != nil {
 		respondWithError(w, 500, "There was a problem retrieving chirps")
 		return
 	}
 
-	respondWithJSON(w, 200, chirpList)
+	if !paginated {
+		respondWithJSON(w, 200, response.Chirps)
+		return
+	}
+
+	setNextLink(w, r, limit, page.NextCursor)
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) searchChirps(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	authorID, _ := strconv.Atoi(r.URL.Query().Get("author_id"))
+
+	// Search results are always paged, they are unbounded otherwise
+	limit, cursor, paginated, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if !paginated {
+		limit = defaultPageSize
+	}
+
+	page, err := cfg.db.SearchChirps(database.SearchQuery{
+		Query:    q,
+		AuthorID: authorID,
+		Limit:    limit,
+		Cursor:   cursor,
+	})
+	if errors.Is(err, database.ErrEmptySearch) {
+		respondWithError(w, 400, "Search query is required")
+		return
+	}
+	if errors.Is(err, database.ErrInvalidCursor) {
+		respondWithError(w, 400, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem searching chirps")
+		return
+	}
+
+	response, err := cfg.pageResponse(cfg.viewer(r), page)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem searching chirps")
+		return
+	}
+
+	setNextLink(w, r, limit, page.NextCursor)
+	respondWithJSON(w, 200, response)
 }
 
 func (cfg *apiConfig) readChirp(w http.ResponseWriter, r *http.Request) {
@@ -85,24 +190,32 @@ func (cfg *apiConfig) readChirp(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Chirp doesn't exist
-	if chirp == (database.Chirp{}) {
+	if chirp.ID == 0 {
 		respondWithError(w, 404, "Chirp doesn't exist")
 		return
 	}
 
-	respondWithJSON(w, 200, chirp)
+	response, err := cfg.chirpResponse(cfg.viewer(r), chirp)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving chirps")
+		return
+	}
+
+	respondWithJSON(w, 200, response)
 }
 
 func (cfg *apiConfig) createChirp(w http.ResponseWriter, r *http.Request) {
 	auth := r.Header.Get("Authorization")
-	userId, err := authenticate(cfg.jwtSecret, auth)
+	userId, err := cfg.authenticate(auth)
 	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
 	type parameters struct {
-		Body string `json:"body"`
+		Body      string `json:"body"`
+		InReplyTo int    `json:"in_reply_to"`
+		QuoteOf   int    `json:"quote_of"`
 	}
 
 	params := parameters{}
@@ -119,20 +232,197 @@ func (cfg *apiConfig) createChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if params.InReplyTo != 0 && params.QuoteOf != 0 {
+		respondWithError(w, 400, "A chirp can't both reply to and quote a chirp")
+		return
+	}
+
 	cleanedBody := cleanProfanity(params.Body)
 
-	chirp, err := cfg.db.CreateChirp(userId, cleanedBody)
+	var chirp database.Chirp
+	switch {
+	case params.InReplyTo != 0:
+		chirp, err = cfg.db.CreateReply(userId, params.InReplyTo, cleanedBody)
+	case params.QuoteOf != 0:
+		chirp, err = cfg.db.CreateQuote(userId, params.QuoteOf, cleanedBody)
+	default:
+		chirp, err = cfg.db.CreateChirp(userId, cleanedBody)
+	}
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 400, "The chirp being replied to or quoted doesn't exist")
+		return
+	}
 	if err != nil {
 		respondWithError(w, 500, "There was a problem creating the chirp")
 		return
 	}
 
-	respondWithJSON(w, 201, chirp)
+	respondWithJSON(w, 201, chirpResponse{Chirp: chirp})
+}
+
+func (cfg *apiConfig) updateChirp(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	chirpIDParam := chi.URLParam(r, "chirp_id")
+	chirpID, err := strconv.Atoi(chirpIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "Chirp ID must be an integer")
+		return
+	}
+
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+
+	if err != nil {
+		respondWithError(w, 500, "Something went wrong")
+		return
+	}
+
+	if len(params.Body) > 140 {
+		respondWithError(w, 400, "Chirp is too long")
+		return
+	}
+
+	cleanedBody := cleanProfanity(params.Body)
+
+	chirp, err := cfg.db.UpdateChirp(userId, chirpID, cleanedBody)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, "Chirp doesn't exist")
+		return
+	}
+	if errors.Is(err, database.ErrNotAuthor) {
+		respondWithError(w, 403, "Only the author can edit a chirp")
+		return
+	}
+	if errors.Is(err, database.ErrRechirp) {
+		respondWithError(w, 400, "Rechirps can't be edited")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem updating the chirp")
+		return
+	}
+
+	response, err := cfg.chirpResponse(cfg.viewer(r), chirp)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem updating the chirp")
+		return
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) rechirp(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	chirpIDParam := chi.URLParam(r, "chirp_id")
+	chirpID, err := strconv.Atoi(chirpIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "Chirp ID must be an integer")
+		return
+	}
+
+	rechirp, created, err := cfg.db.Rechirp(userId, chirpID)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, "Chirp doesn't exist")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem rechirping the chirp")
+		return
+	}
+
+	response, err := cfg.chirpResponse(cfg.viewer(r), rechirp)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem rechirping the chirp")
+		return
+	}
+
+	// Rechirping again is harmless, it just returns the existing rechirp
+	code := 200
+	if created {
+		code = 201
+	}
+	respondWithJSON(w, code, response)
+}
+
+func (cfg *apiConfig) unrechirp(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	chirpIDParam := chi.URLParam(r, "chirp_id")
+	chirpID, err := strconv.Atoi(chirpIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "Chirp ID must be an integer")
+		return
+	}
+
+	rechirp, err := cfg.db.Unrechirp(userId, chirpID)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, "Chirp hasn't been rechirped")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem removing the rechirp")
+		return
+	}
+
+	response, err := cfg.chirpResponse(cfg.viewer(r), rechirp)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem removing the rechirp")
+		return
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) listRevisions(w http.ResponseWriter, r *http.Request) {
+	chirpIDParam := chi.URLParam(r, "chirp_id")
+	chirpID, err := strconv.Atoi(chirpIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "Chirp ID must be an integer")
+		return
+	}
+
+	revisions, err := cfg.db.ListRevisions(chirpID)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, "Chirp doesn't exist")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving revisions")
+		return
+	}
+
+	respondWithJSON(w, 200, revisions)
 }
 
 func (cfg *apiConfig) deleteChirp(w http.ResponseWriter, r *http.Request) {
 	auth := r.Header.Get("Authorization")
-	userId, err := authenticate(cfg.jwtSecret, auth)
+	userId, err := cfg.authenticate(auth)
 	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
@@ -181,7 +471,7 @@ func (cfg *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
 
 func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
 	auth := r.Header.Get("Authorization")
-	userId, err := authenticate(cfg.jwtSecret, auth)
+	userId, err := cfg.authenticate(auth)
 	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
@@ -212,9 +502,11 @@ func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
 
 func (cfg *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		Email            string `json:"email"`
-		Password         string `json:"password"`
-		ExpiresInSeconds int    `json:"expires_in_seconds"`
+		Email                   string `json:"email"`
+		Password                string `json:"password"`
+		ExpiresInSeconds        int    `json:"expires_in_seconds"`
+		RefreshExpiresInSeconds int    `json:"refresh_expires_in_seconds"`
+		DeviceName              string `json:"device_name"`
 	}
 
 	params := parameters{}
@@ -227,38 +519,52 @@ func (cfg *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user, err := cfg.db.Login(params.Email, params.Password)
-	if err != nil || user == (database.User{}) {
+	if err != nil || user.ID == 0 {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
+	if user.DeletedAt != nil {
+		respondWithError(w, 403, "This account is deleted, restore it to log in")
+		return
+	}
 
-	// User successfully authenticated so we can generate access tokens
+	// User successfully authenticated so we can generate access tokens,
+	// lasting as long as the client asked within the configured bounds
 	userIdStr := fmt.Sprintf("%v", user.ID)
-	accessToken, accessErr := generateAccessToken(cfg.jwtSecret, userIdStr)
-	refreshToken, refreshErr := generateRefreshToken(cfg.jwtSecret, userIdStr)
+	now := time.Now()
+	expiresAt := now.Add(cfg.accessLifetime.clamp(time.Duration(params.ExpiresInSeconds) * time.Second))
+	refreshExpiresAt := now.Add(cfg.refreshLifetime.clamp(time.Duration(params.RefreshExpiresInSeconds) * time.Second))
+	accessToken, accessErr := generateAccessToken(cfg.keys, userIdStr, expiresAt)
+	refreshToken, refreshErr := generateRefreshToken(cfg.keys, userIdStr, refreshExpiresAt)
 	if accessErr != nil || refreshErr != nil {
 		respondWithError(w, 500, "Could not generate JWT")
 		return
 	}
 
-	err = cfg.db.SaveRefreshToken(refreshToken)
+	session, err := cfg.db.SaveRefreshToken(user.ID, refreshToken, device(r, params.DeviceName), refreshExpiresAt)
 	if err != nil {
 		respondWithError(w, 500, "Could not save refresh token")
 		return
 	}
 
 	access := struct {
-		ID           int    `json:"id"`
-		Email        string `json:"email"`
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-		IsChirpyRed  bool   `json:"is_chirpy_red"`
+		ID                    int       `json:"id"`
+		Email                 string    `json:"email"`
+		Token                 string    `json:"token"`
+		ExpiresAt             time.Time `json:"expires_at"`
+		RefreshToken          string    `json:"refresh_token"`
+		RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+		SessionID             string    `json:"session_id"`
+		IsChirpyRed           bool      `json:"is_chirpy_red"`
 	}{
-		ID:           user.ID,
-		Email:        user.Email,
-		Token:        accessToken,
-		RefreshToken: refreshToken,
-		IsChirpyRed:  user.IsChirpyRed,
+		ID:                    user.ID,
+		Email:                 user.Email,
+		Token:                 accessToken,
+		ExpiresAt:             expiresAt.UTC().Truncate(time.Second),
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: refreshExpiresAt.UTC().Truncate(time.Second),
+		SessionID:             session.ID,
+		IsChirpyRed:           user.IsChirpyRed,
 	}
 
 	respondWithJSON(w, 200, access)
@@ -266,32 +572,83 @@ func (cfg *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 
 func (cfg *apiConfig) refresh(w http.ResponseWriter, r *http.Request) {
 	auth := r.Header.Get("Authorization")
-	userId, err := authenticateRefresh(cfg.jwtSecret, auth)
+	claims, err := parseToken(cfg.keys, auth, "chirpy-refresh")
 	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
+	userId, _ := strconv.Atoi(claims.Subject)
+
+	// The body is optional, it only asks for a shorter access token
+	type parameters struct {
+		ExpiresInSeconds int `json:"expires_in_seconds"`
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, 500, "Something went wrong")
+		return
+	}
 
 	splitAuth := strings.Split(auth, " ")
 	token := splitAuth[1]
 
-	valid := cfg.db.CheckRefreshToken(token)
-	if !valid {
+	// Tokens issued before their owner was recorded aren't revoked along
+	// with a deleted account, so check the account too
+	user, err := cfg.db.ReadUser(userId)
+	if err != nil || user.DeletedAt != nil {
 		respondWithError(w, 401, "The refresh token is invalid")
 		return
 	}
 
+	// The new refresh token lasts as long as the one it replaces, so a
+	// shorter lifetime asked for at login sticks
+	var refreshLifetime time.Duration
+	if claims.IssuedAt != nil && claims.ExpiresAt != nil {
+		refreshLifetime = claims.ExpiresAt.Sub(claims.IssuedAt.Time)
+	}
+
 	userIdStr := fmt.Sprintf("%v", userId)
-	accessToken, err := generateAccessToken(cfg.jwtSecret, userIdStr)
-	if err != nil {
+	now := time.Now()
+	expiresAt := now.Add(cfg.accessLifetime.clamp(time.Duration(params.ExpiresInSeconds) * time.Second))
+	refreshExpiresAt := now.Add(cfg.refreshLifetime.clamp(refreshLifetime))
+	accessToken, accessErr := generateAccessToken(cfg.keys, userIdStr, expiresAt)
+	refreshToken, refreshErr := generateRefreshToken(cfg.keys, userIdStr, refreshExpiresAt)
+	if accessErr != nil || refreshErr != nil {
 		respondWithError(w, 500, "Could not generate JWT")
 		return
 	}
 
+	// Every refresh swaps the refresh token for a new one. Seeing an old
+	// one again means it was copied, so the whole login is revoked.
+	rotated, err := cfg.db.RotateRefreshToken(token, refreshToken, device(r, ""), refreshExpiresAt)
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		log.Printf("security: reused refresh token for user %d from %s, revoked token family %s", rotated.UserID, r.RemoteAddr, rotated.Family)
+		respondWithError(w, 401, "The refresh token is invalid")
+		return
+	}
+	if errors.Is(err, database.ErrInvalidRefreshToken) {
+		respondWithError(w, 401, "The refresh token is invalid")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "Could not save refresh token")
+		return
+	}
+
 	access := struct {
-		Token string `json:"token"`
+		Token                 string    `json:"token"`
+		ExpiresAt             time.Time `json:"expires_at"`
+		RefreshToken          string    `json:"refresh_token"`
+		RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
 	}{
-		Token: accessToken,
+		Token:                 accessToken,
+		ExpiresAt:             expiresAt.UTC().Truncate(time.Second),
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: refreshExpiresAt.UTC().Truncate(time.Second),
 	}
 
 	respondWithJSON(w, 200, access)
@@ -299,7 +656,7 @@ func (cfg *apiConfig) refresh(w http.ResponseWriter, r *http.Request) {
 
 func (cfg *apiConfig) revoke(w http.ResponseWriter, r *http.Request) {
 	auth := r.Header.Get("Authorization")
-	_, err := authenticateRefresh(cfg.jwtSecret, auth)
+	_, err := authenticateRefresh(cfg.keys, auth)
 	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
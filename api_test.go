@@ -0,0 +1,495 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/honesea/go-chirpy/internal/database"
+)
+
+func TestListChirpsPagination(t *testing.T) {
+	db := database.NewMemoryDB()
+	for i := 0; i < 3; i++ {
+		db.CreateChirp(1, "chirp")
+	}
+	cfg := apiConfig{db: db}
+
+	// Without paging parameters the response stays a plain array
+	w := httptest.NewRecorder()
+	cfg.listChirps(w, httptest.NewRequest("GET", "/api/chirps", nil))
+
+	chirps := []database.Chirp{}
+	err := json.Unmarshal(w.Body.Bytes(), &chirps)
+	if err != nil || len(chirps) != 3 {
+		t.Fatalf("Expected 3 chirps but got %v (%v)", w.Body.String(), err)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.listChirps(w, httptest.NewRequest("GET", "/api/chirps?limit=2", nil))
+
+	page := database.ChirpPage{}
+	err = json.Unmarshal(w.Body.Bytes(), &page)
+	if err != nil || len(page.Chirps) != 2 || page.NextCursor == "" {
+		t.Fatalf("Expected a page of 2 with a cursor but got %v (%v)", w.Body.String(), err)
+	}
+
+	link := w.Header().Get("Link")
+	if !strings.Contains(link, "cursor="+page.NextCursor) || !strings.HasSuffix(link, `rel="next"`) {
+		t.Errorf("Expected a next Link header but got %q", link)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.listChirps(w, httptest.NewRequest("GET", "/api/chirps?limit=2&cursor="+page.NextCursor, nil))
+
+	page = database.ChirpPage{}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page.Chirps) != 1 || page.NextCursor != "" || w.Header().Get("Link") != "" {
+		t.Errorf("Expected a last page of 1 but got %v", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	cfg.listChirps(w, httptest.NewRequest("GET", "/api/chirps?cursor=nonsense", nil))
+	if w.Code != 400 {
+		t.Errorf("Expected a bad cursor to be rejected but got %v", w.Code)
+	}
+}
+
+func TestReadThread(t *testing.T) {
+	db := database.NewMemoryDB()
+	root, _ := db.CreateChirp(1, "root")
+	reply, _ := db.CreateReply(2, root.ID, "reply")
+	nested, _ := db.CreateReply(1, reply.ID, "nested")
+	db.CreateReply(1, nested.ID, "too deep")
+	db.CreateReply(3, root.ID, "another reply")
+	cfg := apiConfig{db: db}
+
+	r := chi.NewRouter()
+	r.Get("/api/chirps/{chirp_id}/thread", cfg.readThread)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/chirps/1/thread?depth=2&limit=1", nil))
+
+	th := thread{}
+	err := json.Unmarshal(w.Body.Bytes(), &th)
+	if err != nil || len(th.Chirp.Replies) != 1 || th.Chirp.NextCursor == "" {
+		t.Fatalf("Expected one reply and a cursor but got %v (%v)", w.Body.String(), err)
+	}
+
+	child := th.Chirp.Replies[0]
+	if child.ID != reply.ID || len(child.Replies) != 1 || child.Replies[0].ID != nested.ID {
+		t.Errorf("Expected %v to hold %v but got %v", reply.ID, nested.ID, w.Body.String())
+	}
+	if child.Replies[0].Replies != nil {
+		t.Errorf("Expected replies to stop at depth 2 but got %v", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/chirps/3/thread", nil))
+
+	th = thread{}
+	json.Unmarshal(w.Body.Bytes(), &th)
+	if len(th.Ancestors) != 2 || th.Ancestors[0].ID != root.ID || th.Ancestors[1].ID != reply.ID {
+		t.Errorf("Expected ancestors [1 2] but got %v", w.Body.String())
+	}
+}
+
+func TestReadThreadBounds(t *testing.T) {
+	db := database.NewMemoryDB()
+	root, _ := db.CreateChirp(1, "root")
+	reply, _ := db.CreateReply(2, root.ID, "reply")
+	for i := 0; i < threadReplyPageSize+1; i++ {
+		db.CreateReply(1, reply.ID, "nested")
+	}
+	cfg := apiConfig{db: db}
+
+	r := chi.NewRouter()
+	r.Get("/api/chirps/{chirp_id}/thread", cfg.readThread)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/chirps/1/thread?limit=100", nil))
+
+	th := thread{}
+	json.Unmarshal(w.Body.Bytes(), &th)
+	if len(th.Chirp.Replies) != 1 {
+		t.Fatalf("Expected one reply but got %v", w.Body.String())
+	}
+
+	child := th.Chirp.Replies[0]
+	if len(child.Replies) != threadReplyPageSize || child.NextCursor == "" {
+		t.Errorf("Expected nested replies to be paged by %d with a cursor but got %v", threadReplyPageSize, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/chirps/2/thread?cursor="+child.NextCursor, nil))
+
+	th = thread{}
+	json.Unmarshal(w.Body.Bytes(), &th)
+	if len(th.Chirp.Replies) != 1 || th.Chirp.NextCursor != "" {
+		t.Errorf("Expected the nested cursor to page the last reply but got %v", w.Body.String())
+	}
+}
+
+func TestLikedByMe(t *testing.T) {
+	db := database.NewMemoryDB()
+	author, _ := db.CreateUser("alice@example.com", "hunter2")
+	db.CreateUser("bob@example.com", "hunter2")
+	chirp, _ := db.CreateChirp(author.ID, "chirp")
+	db.LikeChirp(2, chirp.ID)
+	cfg := apiConfig{db: db, keys: newHMACKeyring("secret")}
+
+	token, err := generateAccessToken(cfg.keys, "2", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, c := range []struct {
+		auth     string
+		expected bool
+	}{
+		{"", false},
+		{"Bearer " + token, true},
+	} {
+		req := httptest.NewRequest("GET", "/api/chirps", nil)
+		req.Header.Set("Authorization", c.auth)
+		w := httptest.NewRecorder()
+		cfg.listChirps(w, req)
+
+		chirps := []chirpResponse{}
+		err = json.Unmarshal(w.Body.Bytes(), &chirps)
+		if err != nil || len(chirps) != 1 || chirps[0].LikeCount != 1 || chirps[0].LikedByMe != c.expected {
+			t.Errorf("Expected liked_by_me %v but got %v (%v)", c.expected, w.Body.String(), err)
+		}
+	}
+}
+
+func TestLikedByMeRechirp(t *testing.T) {
+	db := database.NewMemoryDB()
+	author, _ := db.CreateUser("alice@example.com", "hunter2")
+	db.CreateUser("bob@example.com", "hunter2")
+	chirp, _ := db.CreateChirp(author.ID, "chirp")
+	rechirp, _, _ := db.Rechirp(author.ID, chirp.ID)
+	cfg := apiConfig{db: db, keys: newHMACKeyring("secret")}
+
+	token, err := generateAccessToken(cfg.keys, "2", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Post("/api/chirps/{chirp_id}/likes", cfg.likeChirp)
+
+	// Like through the rechirp, the like goes to the original
+	req := httptest.NewRequest("POST", fmt.Sprintf("/api/chirps/%d/likes", rechirp.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Expected the like to succeed but got %v %v", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/chirps", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	cfg.listChirps(w, req)
+
+	chirps := []chirpResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &chirps)
+	if err != nil || len(chirps) != 2 {
+		t.Fatalf("Expected the chirp and its rechirp but got %v (%v)", w.Body.String(), err)
+	}
+	for _, c := range chirps {
+		if !c.LikedByMe {
+			t.Errorf("Expected %v to be liked_by_me but got %v", c.ID, w.Body.String())
+		}
+	}
+}
+
+func TestRechirp(t *testing.T) {
+	db := database.NewMemoryDB()
+	author, _ := db.CreateUser("alice@example.com", "hunter2")
+	db.CreateUser("bob@example.com", "hunter2")
+	chirp, _ := db.CreateChirp(author.ID, "chirp")
+	db.LikeChirp(2, chirp.ID)
+	cfg := apiConfig{db: db, keys: newHMACKeyring("secret")}
+
+	token, err := generateAccessToken(cfg.keys, "2", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Post("/api/chirps/{chirp_id}/rechirp", cfg.rechirp)
+	r.Delete("/api/chirps/{chirp_id}/rechirp", cfg.unrechirp)
+
+	for _, c := range []struct {
+		method string
+		code   int
+	}{
+		{"POST", 201},
+		{"POST", 200},
+		{"DELETE", 200},
+	} {
+		req := httptest.NewRequest(c.method, "/api/chirps/1/rechirp", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		response := map[string]any{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if _, ok := response["liked_by_me"]; w.Code != c.code || !ok {
+			t.Errorf("Expected %s to return %v with liked_by_me but got %v %v", c.method, c.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestReadProfile(t *testing.T) {
+	db := database.NewMemoryDB()
+	user, _ := db.CreateUser("alice@example.com", "hunter2")
+	handle := "alice"
+	db.UpdateProfile(user.ID, database.ProfileUpdate{Handle: &handle})
+	db.CreateChirp(user.ID, "chirp")
+	cfg := apiConfig{db: db}
+
+	r := chi.NewRouter()
+	r.Get("/api/users/{user_id}", cfg.readProfile)
+
+	for _, path := range []string{"/api/users/1", "/api/users/alice", "/api/users/@Alice"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		if w.Code != 200 || !strings.Contains(w.Body.String(), `"handle":"alice"`) || strings.Contains(w.Body.String(), "example.com") {
+			t.Errorf("Expected %v to show the profile without the email but got %v %v", path, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/users/bob", nil))
+	if w.Code != 404 {
+		t.Errorf("Expected 404 for an unknown handle but got %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.listChirps(w, httptest.NewRequest("GET", "/api/chirps?expand=author", nil))
+
+	chirps := []chirpResponse{}
+	err := json.Unmarshal(w.Body.Bytes(), &chirps)
+	if err != nil || len(chirps) != 1 || chirps[0].Author == nil || chirps[0].Author.Handle != "alice" {
+		t.Errorf("Expected the author to be embedded but got %v (%v)", w.Body.String(), err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	db := database.NewMemoryDB()
+	user, _ := db.CreateUser("alice@example.com", "hunter2")
+	db.CreateUser("bob@example.com", "hunter2")
+	chirp, _ := db.CreateChirp(user.ID, "first chirp")
+	db.UpdateChirp(user.ID, chirp.ID, "first chirp, edited")
+	cfg := apiConfig{db: db, keys: newHMACKeyring("secret"), exports: newExports(), exportSecret: "export secret"}
+
+	r := chi.NewRouter()
+	r.Post("/api/users/export", cfg.createExport)
+	r.Get("/api/users/export/{export_id}", cfg.readExport)
+	r.Get("/api/exports/{export_id}/download", cfg.downloadExport)
+
+	token, _ := generateAccessToken(cfg.keys, "1", time.Now().Add(time.Hour))
+	other, _ := generateAccessToken(cfg.keys, "2", time.Now().Add(time.Hour))
+
+	req := httptest.NewRequest("POST", "/api/users/export", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	location := w.Header().Get("Location")
+	if w.Code != 202 || location == "" {
+		t.Fatalf("Expected 202 with a Location but got %v %v", w.Code, w.Body.String())
+	}
+
+	// Someone else can't see the export
+	req = httptest.NewRequest("GET", location, nil)
+	req.Header.Set("Authorization", "Bearer "+other)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Errorf("Expected 404 for another user but got %v", w.Code)
+	}
+
+	status := struct {
+		Status      string `json:"status"`
+		DownloadURL string `json:"download_url"`
+	}{}
+	for i := 0; i < 100 && status.Status != exportReady; i++ {
+		time.Sleep(10 * time.Millisecond)
+
+		req = httptest.NewRequest("GET", location, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		json.Unmarshal(w.Body.Bytes(), &status)
+	}
+	if status.Status != exportReady || status.DownloadURL == "" {
+		t.Fatalf("Expected the export to be ready but got %v", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", status.DownloadURL+"0", nil))
+	if w.Code != 403 {
+		t.Errorf("Expected 403 for a tampered link but got %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", status.DownloadURL, nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected the archive but got %v %v", w.Code, w.Body.String())
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	files := map[string]string{}
+	for _, file := range archive.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		buf := bytes.Buffer{}
+		buf.ReadFrom(rc)
+		rc.Close()
+		files[file.Name] = buf.String()
+	}
+
+	for _, name := range []string{"profile.json", "chirps.json", "likes.json", "following.json", "followers.json", "sessions.json", "index.html"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("Expected %v in the archive", name)
+		}
+	}
+	if !strings.Contains(files["chirps.json"], "first chirp, edited") || !strings.Contains(files["chirps.json"], `"revisions"`) {
+		t.Errorf("Expected chirps with revisions but got %v", files["chirps.json"])
+	}
+	if strings.Contains(files["profile.json"], "password") {
+		t.Errorf("Expected no password in the profile but got %v", files["profile.json"])
+	}
+
+	// Without a secret the links could be forged
+	cfg.exportSecret = ""
+	req = httptest.NewRequest("POST", "/api/users/export", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 500 {
+		t.Errorf("Expected exports to be refused without a signing secret but got %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/exports/x/download?expires=9999999999&signature="+exportSignature("", "x", 9999999999), nil))
+	if w.Code != 403 {
+		t.Errorf("Expected a link signed without a secret to be rejected but got %v", w.Code)
+	}
+}
+
+func TestRefreshRotation(t *testing.T) {
+	db := database.NewMemoryDB()
+	db.CreateUser("alice@example.com", "hunter2")
+	cfg := apiConfig{
+		db:              db,
+		keys:            newHMACKeyring("secret"),
+		accessLifetime:  defaultAccessLifetime,
+		refreshLifetime: defaultRefreshLifetime,
+	}
+
+	w := httptest.NewRecorder()
+	cfg.login(w, httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"email":"alice@example.com","password":"hunter2"}`)))
+
+	tokens := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	first := tokens.RefreshToken
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/refresh", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		cfg.refresh(w, req)
+		return w
+	}
+
+	w = refresh(first)
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if w.Code != 200 || tokens.RefreshToken == "" || tokens.RefreshToken == first {
+		t.Fatalf("Expected a new refresh token but got %v %v", w.Code, w.Body.String())
+	}
+	second := tokens.RefreshToken
+
+	if w = refresh(first); w.Code != 401 {
+		t.Errorf("Expected the rotated token to be rejected but got %v", w.Code)
+	}
+	if w = refresh(second); w.Code != 401 {
+		t.Errorf("Expected reuse to revoke the newer token too but got %v", w.Code)
+	}
+}
+
+func TestTokenLifetimes(t *testing.T) {
+	db := database.NewMemoryDB()
+	db.CreateUser("alice@example.com", "hunter2")
+	cfg := apiConfig{
+		db:              db,
+		keys:            newHMACKeyring("secret"),
+		accessLifetime:  tokenLifetime{Default: time.Hour, Max: 2 * time.Hour},
+		refreshLifetime: tokenLifetime{Default: 24 * time.Hour, Max: 24 * time.Hour},
+	}
+
+	tokens := struct {
+		ExpiresAt             time.Time `json:"expires_at"`
+		RefreshToken          string    `json:"refresh_token"`
+		RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+	}{}
+	expectIn := func(name string, expiresAt time.Time, lifetime time.Duration) {
+		t.Helper()
+		if d := time.Until(expiresAt) - lifetime; d > time.Second || d < -2*time.Second {
+			t.Errorf("Expected the %v to last %v but it expires at %v", name, lifetime, expiresAt)
+		}
+	}
+
+	for _, c := range []struct {
+		requested string
+		expected  time.Duration
+	}{
+		{"", time.Hour},
+		{`, "expires_in_seconds": 60`, time.Minute},
+		{`, "expires_in_seconds": 86400`, 2 * time.Hour},
+	} {
+		body := `{"email":"alice@example.com","password":"hunter2"` + c.requested + `}`
+		w := httptest.NewRecorder()
+		cfg.login(w, httptest.NewRequest("POST", "/api/login", strings.NewReader(body)))
+
+		json.Unmarshal(w.Body.Bytes(), &tokens)
+		expectIn("access token", tokens.ExpiresAt, c.expected)
+		expectIn("refresh token", tokens.RefreshTokenExpiresAt, 24*time.Hour)
+	}
+
+	w := httptest.NewRecorder()
+	body := `{"email":"alice@example.com","password":"hunter2","refresh_expires_in_seconds":600}`
+	cfg.login(w, httptest.NewRequest("POST", "/api/login", strings.NewReader(body)))
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+
+	// The shorter refresh lifetime carries over to the rotated token
+	req := httptest.NewRequest("POST", "/api/refresh", strings.NewReader(`{"expires_in_seconds":120}`))
+	req.Header.Set("Authorization", "Bearer "+tokens.RefreshToken)
+	w = httptest.NewRecorder()
+	cfg.refresh(w, req)
+
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if w.Code != 200 {
+		t.Fatalf("Expected the token to refresh but got %v %v", w.Code, w.Body.String())
+	}
+	expectIn("refreshed access token", tokens.ExpiresAt, 2*time.Minute)
+	expectIn("rotated refresh token", tokens.RefreshTokenExpiresAt, 10*time.Minute)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"time"
+
+	"github.com/honesea/go-chirpy/internal/database"
+)
+
+// archivedChirp is a chirp with its edit history.
+type archivedChirp struct {
+	database.Chirp
+	Revisions []database.Revision `json:"revisions"`
+}
+
+// archiveData is everything a user's export holds.
+type archiveData struct {
+	ExportedAt time.Time          `json:"exported_at"`
+	User       database.User      `json:"user"`
+	Chirps     []archivedChirp    `json:"chirps"`
+	Likes      []database.Chirp   `json:"likes"`
+	Following  []database.Profile `json:"following"`
+	Followers  []database.Profile `json:"followers"`
+	Sessions   []database.Session `json:"sessions"`
+}
+
+// collectArchive reads all of userID's data from db.
+func collectArchive(db database.Store, userID int) (archiveData, error) {
+	data := archiveData{ExportedAt: time.Now().UTC()}
+
+	user, err := db.ReadUser(userID)
+	if err != nil {
+		return archiveData{}, err
+	}
+	data.User = user
+
+	chirps, err := db.ListChirps(database.ChirpQuery{AuthorID: userID})
+	if err != nil {
+		return archiveData{}, err
+	}
+	data.Chirps = []archivedChirp{}
+	for _, chirp := range chirps.Chirps {
+		revisions, err := db.ListRevisions(chirp.ID)
+		if err != nil {
+			return archiveData{}, err
+		}
+		data.Chirps = append(data.Chirps, archivedChirp{Chirp: chirp, Revisions: revisions})
+	}
+
+	likes, err := db.ListLikes(database.LikeQuery{UserID: userID})
+	if err != nil {
+		return archiveData{}, err
+	}
+	data.Likes = likes.Chirps
+
+	following, err := db.ListFollowing(database.FollowQuery{UserID: userID})
+	if err != nil {
+		return archiveData{}, err
+	}
+	data.Following = profiles(following.Users)
+
+	followers, err := db.ListFollowers(database.FollowQuery{UserID: userID})
+	if err != nil {
+		return archiveData{}, err
+	}
+	data.Followers = profiles(followers.Users)
+
+	data.Sessions, err = db.ListSessions(userID)
+	if err != nil {
+		return archiveData{}, err
+	}
+
+	return data, nil
+}
+
+func profiles(users []database.User) []database.Profile {
+	profiles := []database.Profile{}
+	for _, user := range users {
+		profiles = append(profiles, user.Profile())
+	}
+	return profiles
+}
+
+// buildArchive zips data up as one JSON file per section plus index.html,
+// which shows the same data without needing anything else.
+func buildArchive(data archiveData) ([]byte, error) {
+	buf := bytes.Buffer{}
+	zw := zip.NewWriter(&buf)
+
+	files := []struct {
+		name  string
+		value any
+	}{
+		{"profile.json", data.User},
+		{"chirps.json", data.Chirps},
+		{"likes.json", data.Likes},
+		{"following.json", data.Following},
+		{"followers.json", data.Followers},
+		{"sessions.json", data.Sessions},
+	}
+	for _, file := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: data.ExportedAt})
+		if err != nil {
+			return nil, err
+		}
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(file.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "index.html", Method: zip.Deflate, Modified: data.ExportedAt})
+	if err != nil {
+		return nil, err
+	}
+	err = archiveViewer.Execute(w, data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+var archiveViewer = template.Must(template.New("index.html").Parse(`<!DOCTYPE html>
+<html>
+
+<head>
+	<meta charset="utf-8">
+	<title>Chirpy data export</title>
+</head>
+
+<body>
+	<h1>{{with .User.DisplayName}}{{.}}{{else}}{{.User.Email}}{{end}}{{with .User.Handle}} (@{{.}}){{end}}</h1>
+	<p>Exported {{.ExportedAt.Format "2 Jan 2006 15:04 MST"}}</p>
+	<p>{{.User.Bio}}</p>
+
+	<h2>Chirps ({{len .Chirps}})</h2>
+	<ul>
+		{{range .Chirps}}
+		<li>
+			<p>{{if .RechirpOf}}Rechirped chirp {{.RechirpOf}}{{else}}{{.Body}}{{end}}</p>
+			<small>{{.CreatedAt.Format "2 Jan 2006 15:04"}}{{if .Edited}}, edited {{len .Revisions}} times{{end}}</small>
+		</li>
+		{{end}}
+	</ul>
+
+	<h2>Likes ({{len .Likes}})</h2>
+	<ul>
+		{{range .Likes}}
+		<li>{{.Body}}</li>
+		{{end}}
+	</ul>
+
+	<h2>Following ({{len .Following}})</h2>
+	<ul>
+		{{range .Following}}
+		<li>{{if .Handle}}@{{.Handle}}{{else}}User {{.ID}}{{end}}</li>
+		{{end}}
+	</ul>
+
+	<h2>Followers ({{len .Followers}})</h2>
+	<ul>
+		{{range .Followers}}
+		<li>{{if .Handle}}@{{.Handle}}{{else}}User {{.ID}}{{end}}</li>
+		{{end}}
+	</ul>
+
+	<h2>Sessions ({{len .Sessions}})</h2>
+	<ul>
+		{{range .Sessions}}
+		<li>
+			<p>{{with .DeviceName}}{{.}}{{else}}{{.UserAgent}}{{end}}</p>
+			<small>{{.IP}}, last used {{.LastUsedAt.Format "2 Jan 2006 15:04"}}</small>
+		</li>
+		{{end}}
+	</ul>
+</body>
+
+</html>
+`))
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/honesea/go-chirpy/internal/database"
+)
+
+func (cfg *apiConfig) listHashtag(w http.ResponseWriter, r *http.Request) {
+	tag := database.HashtagKey(chi.URLParam(r, "tag"))
+	if tag == "" {
+		respondWithError(w, 400, "Hashtag is required")
+		return
+	}
+
+	cfg.listEntityChirps(w, r, database.ChirpQuery{Hashtag: tag})
+}
+
+func (cfg *apiConfig) listMentions(w http.ResponseWriter, r *http.Request) {
+	userIDParam := chi.URLParam(r, "user_id")
+	userID, err := strconv.Atoi(userIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "User ID must be an integer")
+		return
+	}
+
+	cfg.listEntityChirps(w, r, database.ChirpQuery{Mentions: userID})
+}
+
+// listEntityChirps responds with a page of the chirps matching query,
+// newest first.
+func (cfg *apiConfig) listEntityChirps(w http.ResponseWriter, r *http.Request, query database.ChirpQuery) {
+	limit, cursor, paginated, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if !paginated {
+		limit = defaultPageSize
+	}
+
+	query.SortDesc = true
+	query.Limit = limit
+	query.Cursor = cursor
+
+	page, err := cfg.db.ListChirps(query)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		respondWithError(w, 400, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving chirps")
+		return
+	}
+
+	response, err := cfg.pageResponse(cfg.viewer(r), page)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving chirps")
+		return
+	}
+
+	setNextLink(w, r, limit, page.NextCursor)
+	respondWithJSON(w, 200, response)
+}
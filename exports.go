@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// exportLifetime is how long a finished export and its download links last.
+const exportLifetime = 24 * time.Hour
+
+// Export statuses.
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+type export struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"-"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when a ready export is thrown away
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	archive []byte
+}
+
+// exports holds the archives being built or waiting to be downloaded. They
+// are only kept in memory, a restart drops them.
+type exports struct {
+	mu   sync.Mutex
+	jobs map[string]*export
+}
+
+func newExports() *exports {
+	return &exports{jobs: map[string]*export{}}
+}
+
+func (e *exports) add(userID int) (export, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return export{}, err
+	}
+
+	job := &export{
+		ID:        hex.EncodeToString(id),
+		UserID:    userID,
+		Status:    exportPending,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sweep()
+	e.jobs[job.ID] = job
+	return *job, nil
+}
+
+func (e *exports) get(id string) (export, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sweep()
+	job, ok := e.jobs[id]
+	if !ok {
+		return export{}, false
+	}
+	return *job, true
+}
+
+func (e *exports) finish(id string, archive []byte, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	job, ok := e.jobs[id]
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		log.Printf("could not export user %d: %v", job.UserID, err)
+		job.Status = exportFailed
+	} else {
+		job.Status = exportReady
+		job.archive = archive
+	}
+	job.ExpiresAt = time.Now().UTC().Add(exportLifetime)
+}
+
+// sweep drops expired exports. The caller must hold the lock.
+func (e *exports) sweep() {
+	now := time.Now()
+	for id, job := range e.jobs {
+		if !job.ExpiresAt.IsZero() && now.After(job.ExpiresAt) {
+			delete(e.jobs, id)
+		}
+	}
+}
+
+// exportSignature signs a download link for export id that works until
+// expires.
+func exportSignature(secret string, id string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "chirpy-export:%s:%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (cfg *apiConfig) downloadURL(job export) string {
+	expires := job.ExpiresAt.Unix()
+	return fmt.Sprintf(
+		"/api/exports/%s/download?expires=%d&signature=%s",
+		job.ID, expires, exportSignature(cfg.exportSecret, job.ID, expires),
+	)
+}
+
+// createExport starts building an archive of the caller's data in the
+// background. Its status can be polled until a download link shows up.
+func (cfg *apiConfig) createExport(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	// Links signed with an empty secret could be forged by anyone
+	if cfg.exportSecret == "" {
+		respondWithError(w, 500, "Exports are not available")
+		return
+	}
+
+	job, err := cfg.exports.add(userId)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem starting the export")
+		return
+	}
+
+	go func() {
+		data, err := collectArchive(cfg.db, userId)
+		if err != nil {
+			cfg.exports.finish(job.ID, nil, err)
+			return
+		}
+
+		archive, err := buildArchive(data)
+		cfg.exports.finish(job.ID, archive, err)
+	}()
+
+	w.Header().Set("Location", "/api/users/export/"+job.ID)
+	respondWithJSON(w, 202, job)
+}
+
+func (cfg *apiConfig) readExport(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	job, ok := cfg.exports.get(chi.URLParam(r, "export_id"))
+	if !ok || job.UserID != userId {
+		respondWithError(w, 404, "Export doesn't exist")
+		return
+	}
+
+	response := struct {
+		export
+		DownloadURL string `json:"download_url,omitempty"`
+	}{export: job}
+	if job.Status == exportReady {
+		response.DownloadURL = cfg.downloadURL(job)
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+// downloadExport serves a ready archive to anyone holding a valid signed
+// link, so it can be fetched without the access token.
+func (cfg *apiConfig) downloadExport(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "export_id")
+
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil {
+		respondWithError(w, 403, "Invalid download link")
+		return
+	}
+
+	signature := r.URL.Query().Get("signature")
+	expected := exportSignature(cfg.exportSecret, id, expires)
+	if cfg.exportSecret == "" || !hmac.Equal([]byte(signature), []byte(expected)) {
+		respondWithError(w, 403, "Invalid download link")
+		return
+	}
+	if time.Now().Unix() > expires {
+		respondWithError(w, 410, "Download link has expired")
+		return
+	}
+
+	job, ok := cfg.exports.get(id)
+	if !ok || job.Status != exportReady {
+		respondWithError(w, 404, "Export doesn't exist")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="chirpy-export.zip"`)
+	w.WriteHeader(200)
+	w.Write(job.archive)
+}
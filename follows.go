@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/honesea/go-chirpy/internal/database"
+)
+
+func (cfg *apiConfig) follow(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	userIDParam := chi.URLParam(r, "user_id")
+	followeeID, err := strconv.Atoi(userIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "User ID must be an integer")
+		return
+	}
+
+	err = cfg.db.Follow(userId, followeeID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, 404, "User doesn't exist")
+		return
+	}
+	if errors.Is(err, database.ErrFollowSelf) {
+		respondWithError(w, 400, "You can't follow yourself")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem following the user")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) unfollow(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	userIDParam := chi.URLParam(r, "user_id")
+	followeeID, err := strconv.Atoi(userIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "User ID must be an integer")
+		return
+	}
+
+	err = cfg.db.Unfollow(userId, followeeID)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem unfollowing the user")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) listFollowers(w http.ResponseWriter, r *http.Request) {
+	cfg.listFollows(w, r, cfg.db.ListFollowers)
+}
+
+func (cfg *apiConfig) listFollowing(w http.ResponseWriter, r *http.Request) {
+	cfg.listFollows(w, r, cfg.db.ListFollowing)
+}
+
+func (cfg *apiConfig) listFollows(w http.ResponseWriter, r *http.Request, list func(database.FollowQuery) (database.UserPage, error)) {
+	userIDParam := chi.URLParam(r, "user_id")
+	userID, err := strconv.Atoi(userIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "User ID must be an integer")
+		return
+	}
+
+	limit, cursor, paginated, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if !paginated {
+		limit = defaultPageSize
+	}
+
+	page, err := list(database.FollowQuery{
+		UserID: userID,
+		Limit:  limit,
+		Cursor: cursor,
+	})
+	if errors.Is(err, database.ErrInvalidCursor) {
+		respondWithError(w, 400, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving users")
+		return
+	}
+
+	// Follow lists are public, so only show profiles
+	response := struct {
+		Users      []database.Profile `json:"users"`
+		NextCursor string             `json:"next_cursor,omitempty"`
+	}{
+		Users:      []database.Profile{},
+		NextCursor: page.NextCursor,
+	}
+	for _, user := range page.Users {
+		response.Users = append(response.Users, user.Profile())
+	}
+
+	setNextLink(w, r, limit, page.NextCursor)
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) timeline(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	limit, cursor, paginated, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if !paginated {
+		limit = defaultPageSize
+	}
+
+	page, err := cfg.db.Timeline(database.TimelineQuery{
+		UserID: userId,
+		Limit:  limit,
+		Cursor: cursor,
+	})
+	if errors.Is(err, database.ErrInvalidCursor) {
+		respondWithError(w, 400, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving the timeline")
+		return
+	}
+
+	response, err := cfg.pageResponse(cfg.viewer(r), page)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving the timeline")
+		return
+	}
+
+	setNextLink(w, r, limit, page.NextCursor)
+	respondWithJSON(w, 200, response)
+}
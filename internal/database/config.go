@@ -0,0 +1,132 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	defaultJSONPath   = "database.json"
+	defaultSQLitePath = "database.db"
+)
+
+// Config selects the backend used by Open and NewMigrator.
+type Config struct {
+	// Driver is one of "json" (the default), "sqlite" or "memory".
+	Driver string
+	// Path is the database file. Each driver has its own default.
+	Path string
+	// IDs is the ID strategy for new records, SequenceIDs (the default) or
+	// SnowflakeIDs.
+	IDs string
+	// FlushInterval is how often the JSON backend writes mutations to disk.
+	// Zero writes every mutation before it returns.
+	FlushInterval time.Duration
+	// TrendingWindows are the windows hashtag trends are kept over, the
+	// first is the default. Empty uses DefaultTrendingWindows.
+	TrendingWindows []time.Duration
+}
+
+func (cfg Config) path() string {
+	if cfg.Path != "" {
+		return cfg.Path
+	}
+
+	if cfg.Driver == "sqlite" {
+		return defaultSQLitePath
+	}
+	return defaultJSONPath
+}
+
+// Open returns the Store selected by cfg. The database must already be
+// migrated to the latest schema version.
+func Open(cfg Config) (Store, error) {
+	err := validIDStrategy(cfg.IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Driver {
+	case "", "json":
+		err := checkMigrated(jsonMigrator{path: cfg.path()})
+		if err != nil {
+			return nil, err
+		}
+
+		db, err := NewDB(cfg.path())
+		if err != nil {
+			return nil, err
+		}
+
+		db.ids = cfg.IDs
+		if len(cfg.TrendingWindows) > 0 {
+			db.setTrendingWindows(cfg.TrendingWindows)
+		}
+		if cfg.FlushInterval > 0 {
+			db.StartFlusher(cfg.FlushInterval)
+		}
+		return db, nil
+	case "sqlite":
+		db, err := NewSQLiteDB(cfg.path())
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkMigrated(sqliteMigrator{db: db.db})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		windows := cfg.TrendingWindows
+		if len(windows) == 0 {
+			windows = DefaultTrendingWindows
+		}
+		err = db.loadTrends(windows)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		db.ids = cfg.IDs
+		return db, nil
+	case "memory":
+		db := NewMemoryDB()
+		db.ids = cfg.IDs
+		if len(cfg.TrendingWindows) > 0 {
+			db.setTrendingWindows(cfg.TrendingWindows)
+		}
+		return db, nil
+	}
+
+	return nil, errors.New("unknown database driver " + cfg.Driver)
+}
+
+// Reset removes the database files selected by cfg.
+func Reset(cfg Config) {
+	path := cfg.path()
+
+	os.Remove(path)
+	switch cfg.Driver {
+	case "", "json":
+		os.Remove(walPath(path))
+	case "sqlite":
+		os.Remove(path + "-wal")
+		os.Remove(path + "-shm")
+	}
+}
+
+func checkMigrated(m Migrator) error {
+	status, err := m.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	if status.Current != status.Latest {
+		return fmt.Errorf("database is at schema version %d but %d is required, run migrate up", status.Current, status.Latest)
+	}
+
+	return nil
+}
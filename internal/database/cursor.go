@@ -0,0 +1,209 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrInvalidCursor is returned for a cursor that is malformed or was issued
+// for a different sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ChirpPage is one page of ListChirps or SearchChirps results. NextCursor is empty on the
+// last page.
+type ChirpPage struct {
+	Chirps     []Chirp `json:"chirps"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// cursor is the position after the last chirp of a page. It holds the sort
+// key of that chirp rather than an offset, so pages stay stable when chirps
+// are created or deleted in between requests.
+type cursor struct {
+	SortBy    string    `json:"s"`
+	SortDesc  bool      `json:"d"`
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"t"`
+}
+
+func newCursor(query ChirpQuery, last Chirp) string {
+	return encodeCursor(cursor{
+		SortBy:    query.sortBy(),
+		SortDesc:  query.SortDesc,
+		ID:        last.ID,
+		CreatedAt: last.CreatedAt,
+	})
+}
+
+// encodeCursor makes an opaque, URL-safe token out of c.
+func encodeCursor(c any) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(token string, c any) error {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+
+	return nil
+}
+
+// decodeCursor returns the query's cursor, or nil when it has none.
+func (query ChirpQuery) decodeCursor() (*cursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	c := cursor{}
+	err := decodeCursor(query.Cursor, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.SortBy != query.sortBy() || c.SortDesc != query.SortDesc {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+func (query ChirpQuery) sortBy() string {
+	if query.SortBy == "" {
+		return SortByID
+	}
+	return query.SortBy
+}
+
+// paginate cuts a page out of chirps, which must already be filtered and
+// sorted for query.
+func paginate(query ChirpQuery, chirps []Chirp) (ChirpPage, error) {
+	c, err := query.decodeCursor()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	if c != nil {
+		after := Chirp{ID: c.ID, CreatedAt: c.CreatedAt}
+
+		start := sort.Search(len(chirps), func(i int) bool {
+			if query.SortDesc {
+				return query.less(chirps[i], after)
+			}
+			return query.less(after, chirps[i])
+		})
+		chirps = chirps[start:]
+	}
+
+	page := ChirpPage{Chirps: chirps}
+	if query.Limit > 0 && len(chirps) > query.Limit {
+		page.Chirps = chirps[:query.Limit]
+		page.NextCursor = newCursor(query, page.Chirps[query.Limit-1])
+	}
+
+	return page, nil
+}
+
+// likeCursor is the last like of a page of ListLikes.
+type likeCursor struct {
+	UserID int `json:"u"`
+	LikeID int `json:"id"`
+}
+
+func (query LikeQuery) decodeCursor() (*likeCursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	c := likeCursor{}
+	err := decodeCursor(query.Cursor, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.UserID != query.UserID {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+func (query LikeQuery) nextCursor(likeID int) string {
+	return encodeCursor(likeCursor{
+		UserID: query.UserID,
+		LikeID: likeID,
+	})
+}
+
+// followCursor is the last follow of a page of followers or followees.
+type followCursor struct {
+	List     string `json:"l"`
+	UserID   int    `json:"u"`
+	FollowID int    `json:"id"`
+}
+
+func (query FollowQuery) decodeCursor(list string) (*followCursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	c := followCursor{}
+	err := decodeCursor(query.Cursor, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.List != list || c.UserID != query.UserID {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+func (query FollowQuery) nextCursor(list string, followID int) string {
+	return encodeCursor(followCursor{
+		List:     list,
+		UserID:   query.UserID,
+		FollowID: followID,
+	})
+}
+
+// timelineCursor is the last chirp of a page of a user's timeline.
+type timelineCursor struct {
+	UserID int `json:"u"`
+	ID     int `json:"id"`
+}
+
+func (query TimelineQuery) decodeCursor() (*timelineCursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	c := timelineCursor{}
+	err := decodeCursor(query.Cursor, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.UserID != query.UserID {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+func (query TimelineQuery) nextCursor(id int) string {
+	return encodeCursor(timelineCursor{
+		UserID: query.UserID,
+		ID:     id,
+	})
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+)
+
+func chirpIDs(chirps []Chirp) string {
+	ids := []int{}
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.ID)
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestListChirpsPagination(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		for i := 0; i < 5; i++ {
+			db.CreateChirp(1, "chirp")
+		}
+
+		for _, sortBy := range []string{SortByID, SortByCreatedAt} {
+			for _, desc := range []bool{false, true} {
+				query := ChirpQuery{SortBy: sortBy, SortDesc: desc}
+				all, _ := db.ListChirps(query)
+
+				paged := []Chirp{}
+				query.Limit = 2
+				for {
+					page, err := db.ListChirps(query)
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					paged = append(paged, page.Chirps...)
+
+					if page.NextCursor == "" {
+						break
+					}
+					query.Cursor = page.NextCursor
+				}
+
+				if chirpIDs(paged) != chirpIDs(all.Chirps) {
+					t.Errorf("Expected pages to add up to %v but got %v", chirpIDs(all.Chirps), chirpIDs(paged))
+				}
+			}
+		}
+	})
+}
+
+func TestListChirpsCursorIsStable(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		for i := 0; i < 5; i++ {
+			db.CreateChirp(1, "chirp")
+		}
+
+		query := ChirpQuery{SortDesc: true, Limit: 2}
+		page, err := db.ListChirps(query)
+		if err != nil || chirpIDs(page.Chirps) != "[5 4]" {
+			t.Fatalf("Expected [5 4] but got %v (%v)", chirpIDs(page.Chirps), err)
+		}
+
+		// Changes between pages must not shift the next one
+		db.DeleteChirp(1, 4)
+		db.CreateChirp(1, "newer")
+
+		query.Cursor = page.NextCursor
+		page, err = db.ListChirps(query)
+		if err != nil || chirpIDs(page.Chirps) != "[3 2]" {
+			t.Errorf("Expected [3 2] but got %v (%v)", chirpIDs(page.Chirps), err)
+		}
+
+		query.SortDesc = false
+		_, err = db.ListChirps(query)
+		if err != ErrInvalidCursor {
+			t.Errorf("Expected a cursor for another sort order to be rejected but got %v", err)
+		}
+	})
+}
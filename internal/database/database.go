@@ -1,188 +1,1231 @@
 package database
 
 import (
-	"encoding/json"
 	"errors"
-	"flag"
 	"log"
-	"os"
+	"slices"
 	"sort"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-const dbFile = "database.json"
+// Store is the persistence layer the API handlers depend on. DB satisfies it
+// for both the JSON file and in-memory backends, SQLiteDB for SQLite.
+type Store interface {
+	ListChirps(query ChirpQuery) (ChirpPage, error)
+	ReadChirp(chirpID int) (Chirp, error)
+	CreateChirp(authorID int, body string) (Chirp, error)
+	CreateReply(authorID int, inReplyTo int, body string) (Chirp, error)
+	CreateQuote(authorID int, quoteOf int, body string) (Chirp, error)
+	// Rechirp reports whether the rechirp was created or already existed
+	Rechirp(userID int, chirpID int) (rechirp Chirp, created bool, err error)
+	Unrechirp(userID int, chirpID int) (Chirp, error)
+	UpdateChirp(authorID int, chirpID int, body string) (Chirp, error)
+	DeleteChirp(authorID int, chirpID int) (Chirp, error)
+	ListRevisions(chirpID int) ([]Revision, error)
+
+	LikeChirp(userID int, chirpID int) (Chirp, error)
+	UnlikeChirp(userID int, chirpID int) (Chirp, error)
+	LikedChirps(userID int, chirpIDs []int) (map[int]bool, error)
+	ListLikes(query LikeQuery) (ChirpPage, error)
+
+	Follow(followerID int, followeeID int) error
+	Unfollow(followerID int, followeeID int) error
+	ListFollowers(query FollowQuery) (UserPage, error)
+	ListFollowing(query FollowQuery) (UserPage, error)
+	Timeline(query TimelineQuery) (ChirpPage, error)
+	SearchChirps(query SearchQuery) (ChirpPage, error)
+	Trending(query TrendingQuery) ([]TrendingTag, error)
+
+	CreateUser(email string, password string) (User, error)
+	UpdateUser(userId int, email string, password string) (User, error)
+	UpdateProfile(userID int, update ProfileUpdate) (User, error)
+	ReadUser(userID int) (User, error)
+	ReadUserByHandle(handle string) (User, error)
+	ReadUsers(userIDs []int) (map[int]User, error)
+	DeleteUser(userID int) (User, error)
+	RestoreUser(email string, password string) (User, error)
+	PurgeDeletedUsers(before time.Time) (int, error)
+	Login(email string, password string) (User, error)
+
+	ActivateChirpyRed(userId int) error
+
+	SaveRefreshToken(userID int, token string, device Device, expiresAt time.Time) (Session, error)
+	CheckRefreshToken(token string) bool
+	RotateRefreshToken(token string, next string, device Device, expiresAt time.Time) (RefreshToken, error)
+	RevokeRefreshToken(token string) error
+	PurgeExpiredTokens(now time.Time) (int, error)
+
+	ListSessions(userID int) ([]Session, error)
+	CountLiveSessions() (int, error)
+	RevokeSession(userID int, sessionID string) error
+	RevokeSessions(userID int) error
+
+	Close() error
+}
 
+// DB keeps the whole Schema in memory and serves reads from it. Mutations
+// are handed to its storage, either straight away or in batches by a
+// background flusher started with StartFlusher.
 type DB struct {
-	mu *sync.RWMutex
+	mu      *sync.RWMutex
+	schema  Schema
+	storage storage
+	ids     string
+
+	// pending holds changes not yet written to storage
+	pending []change
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Fields ListChirps can sort by.
+const (
+	SortByID        = "id"
+	SortByCreatedAt = "created_at"
+)
+
+// ChirpQuery filters and orders ListChirps. Zero values match everything.
+type ChirpQuery struct {
+	AuthorID int
+	// InReplyTo only keeps the direct replies to a chirp.
+	InReplyTo int
+	// Hashtag only keeps chirps tagged with it and Mentions only those
+	// mentioning that user.
+	Hashtag  string
+	Mentions int
+	// SortBy is SortByID (the default) or SortByCreatedAt.
+	SortBy   string
+	SortDesc bool
+	// AfterID and BeforeID only keep chirps with IDs strictly between them,
+	// so clients can page through chirps by ID.
+	AfterID  int
+	BeforeID int
+	// Limit caps the number of chirps per page, 0 returns them all.
+	Limit int
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+}
+
+// Errors returned when a chirp can't be changed.
+var (
+	ErrChirpNotFound = errors.New("chirp does not exist")
+	ErrNotAuthor     = errors.New("invalid author")
+	ErrRechirp       = errors.New("rechirps can't be edited")
+)
+
+// Errors returned for users.
+var (
+	ErrUserNotFound = errors.New("user does not exist")
+	ErrFollowSelf   = errors.New("users can't follow themselves")
+)
+
+type Chirp struct {
+	ID        int       `json:"id"`
+	AuthorID  int       `json:"author_id"`
+	Body      string    `json:"body"`
+	Entities  []Entity  `json:"entities"`
+	Edited    bool      `json:"edited"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// InReplyTo is the chirp this one replies to and RootID the chirp that
+	// started the conversation, both are 0 for a chirp that isn't a reply.
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	RootID    int `json:"root_id,omitempty"`
+
+	// A rechirp reposts RechirpOf as is and has no body of its own, a quote
+	// reposts QuoteOf with a body. The counts are kept on the original.
+	RechirpOf    int `json:"rechirp_of,omitempty"`
+	QuoteOf      int `json:"quote_of,omitempty"`
+	RechirpCount int `json:"rechirp_count"`
+	QuoteCount   int `json:"quote_count"`
+	LikeCount    int `json:"like_count"`
+}
+
+// Revision is an earlier body of an edited chirp. CreatedAt is when that
+// body was posted.
+type Revision struct {
+	ID        int       `json:"id"`
+	ChirpID   int       `json:"chirp_id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Like is a user liking a chirp, each user likes a chirp at most once.
+type Like struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	ChirpID   int       `json:"chirp_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LikeQuery pages through the chirps a user has liked, most recently liked
+// first.
+type LikeQuery struct {
+	UserID int
+	Limit  int
+	Cursor string
+}
+
+// Follow is FollowerID following FolloweeID.
+type Follow struct {
+	ID         int       `json:"id"`
+	FollowerID int       `json:"follower_id"`
+	FolloweeID int       `json:"followee_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// FollowQuery pages through the followers or followees of a user, most
+// recently followed first.
+type FollowQuery struct {
+	UserID int
+	Limit  int
+	Cursor string
+}
+
+// UserPage is one page of users. NextCursor is empty on the last page.
+type UserPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// TimelineQuery pages through the chirps of everyone UserID follows, newest
+// first.
+type TimelineQuery struct {
+	UserID int
+	Limit  int
+	Cursor string
+}
+
+type User struct {
+	ID          int       `json:"id"`
+	Email       string    `json:"email"`
+	Password    string    `json:"password,omitempty"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	AvatarURL   string    `json:"avatar_url"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// DeletedAt is set while the account waits out its grace period before
+	// being purged, its chirps are hidden until then
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// RefreshToken records who a refresh token was issued to. Tokens issued
+// before owners were recorded have a UserID of 0.
+type RefreshToken struct {
+	UserID int `json:"user_id"`
+	// Family is shared by the tokens rotated from the same login. Tokens
+	// issued before rotation have none until they are first rotated.
+	Family  string `json:"family"`
+	Revoked bool   `json:"revoked"`
+	// Rotated is set once the token has been exchanged for the next one in
+	// its family, it can't be used again
+	Rotated   bool      `json:"rotated"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// expired reports whether refreshToken can no longer be used at now.
+func (refreshToken RefreshToken) expired(now time.Time) bool {
+	return !now.Before(refreshToken.ExpiresAt)
+}
+
+type Schema struct {
+	Version       int                     `json:"version"`
+	Chirps        map[int]Chirp           `json:"chirps"`
+	Users         map[int]User            `json:"users"`
+	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	Sessions      map[string]Session      `json:"sessions"`
+	Revisions     map[int]Revision        `json:"revisions"`
+	Likes         map[int]Like            `json:"likes"`
+	Follows       map[int]Follow          `json:"follows"`
+	// Sequences holds the highest ID issued per table so IDs are never
+	// reused after a delete.
+	Sequences map[string]int `json:"sequences"`
+
+	// Secondary indexes, see buildIndexes
+	usersByEmail map[string]int
+	// usersByHandle only holds users that have claimed a handle
+	usersByHandle map[string]int
+	// refreshTokensByUser holds the tokens issued to each user
+	refreshTokensByUser map[int]map[string]struct{}
+	// sessionsByUser holds the IDs of each user's sessions
+	sessionsByUser map[int]map[string]struct{}
+	// chirpsByAuthor holds each author's chirp IDs in ascending order
+	chirpsByAuthor map[int][]int
+	// chirpsByHashtag and mentionsByUser hold chirp IDs by tag and by
+	// mentioned user, also in ascending order
+	chirpsByHashtag map[string][]int
+	mentionsByUser  map[int][]int
+	trends          *trendTracker
+	search          *searchIndex
+	repliesByChirp  map[int]map[int]struct{}
+	// rechirps maps each reposted chirp to its rechirps by user
+	rechirps         map[int]map[int]int
+	revisionsByChirp map[int][]int
+	// likesByUser and likesByChirp map user and chirp to like IDs
+	likesByUser  map[int]map[int]int
+	likesByChirp map[int]map[int]int
+	// following and followers map follower to followee and back to
+	// follow IDs
+	following map[int]map[int]int
+	followers map[int]map[int]int
+}
+
+// NewDB loads the JSON file at path into a DB, replaying and compacting any
+// write-ahead log left behind by a crash.
+func NewDB(path string) (*DB, error) {
+	js := jsonStorage{path: path}
+
+	schema, err := js.load()
+	if err != nil {
+		return nil, err
+	}
+	schema.buildIndexes()
+
+	err = js.close(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{
+		mu:      &sync.RWMutex{},
+		schema:  schema,
+		storage: js,
+	}, nil
+}
+
+// NewMemoryDB returns a DB that only keeps its state in memory, which is
+// useful for tests.
+func NewMemoryDB() *DB {
+	return &DB{
+		mu:      &sync.RWMutex{},
+		schema:  newSchema(),
+		storage: memoryStorage{},
+	}
+}
+
+// StartFlusher switches the DB to write-behind: mutations are only kept in
+// memory until the next flush, every interval. Close flushes whatever is
+// still outstanding.
+func (db *DB) StartFlusher(interval time.Duration) {
+	db.stop = make(chan struct{})
+	db.done = make(chan struct{})
+
+	go func() {
+		defer close(db.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := db.flush()
+				if err != nil {
+					log.Println(err)
+				}
+			case <-db.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the flusher, writes any pending changes and folds the
+// write-ahead log into the snapshot.
+func (db *DB) Close() error {
+	if db.stop != nil {
+		close(db.stop)
+		<-db.done
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.flushLocked()
+	if err != nil {
+		return err
+	}
+
+	return db.storage.close(db.schema)
+}
+
+// commit queues changes that have already been applied to db.schema. They
+// are written immediately unless a flusher is running. If writing them
+// immediately fails the mutation is rolled back, so a caller told it failed
+// doesn't see it go through later. db.mu must be held.
+func (db *DB) commit(changes ...change) error {
+	db.pending = append(db.pending, changes...)
+	if db.stop != nil {
+		return nil
+	}
+
+	err := db.flushLocked()
+	if err != nil {
+		db.rollback()
+	}
+	return err
+}
+
+// rollback drops the pending changes by reloading db.schema from storage. If
+// that fails too they stay queued and the next write retries them. db.mu
+// must be held.
+func (db *DB) rollback() {
+	schema, err := db.storage.load()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Keep the trending windows the DB was opened with
+	schema.trends = db.schema.trends
+	schema.buildIndexes()
+
+	db.schema = schema
+	db.pending = nil
+}
+
+func (db *DB) flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.flushLocked()
+}
+
+// flushLocked writes the pending changes to storage, keeping them queued to
+// retry if that fails. db.mu must be held.
+func (db *DB) flushLocked() error {
+	if len(db.pending) == 0 {
+		return nil
+	}
+
+	err := db.storage.commit(db.schema, db.pending)
+	if err != nil {
+		return err
+	}
+
+	db.pending = nil
+	return nil
+}
+
+func (db *DB) ListChirps(query ChirpQuery) (ChirpPage, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	schema := &db.schema
+
+	candidates := schema.chirpsFor(query.AuthorID)
+	switch {
+	case query.InReplyTo != 0:
+		candidates = schema.repliesTo(query.InReplyTo)
+	case query.Hashtag != "":
+		candidates = schema.chirpsWithIDs(schema.chirpsByHashtag[HashtagKey(query.Hashtag)])
+	case query.Mentions != 0:
+		candidates = schema.chirpsWithIDs(schema.mentionsByUser[query.Mentions])
+	}
+
+	chirpList := []Chirp{}
+	for _, chirp := range candidates {
+		if query.matches(chirp) && !schema.hidden(chirp) {
+			chirpList = append(chirpList, chirp)
+		}
+	}
+
+	sort.Slice(chirpList, func(i, j int) bool {
+		if query.SortDesc {
+			return query.less(chirpList[j], chirpList[i])
+		} else {
+			return query.less(chirpList[i], chirpList[j])
+		}
+	})
+
+	return paginate(query, chirpList)
+}
+
+func (db *DB) SearchChirps(query SearchQuery) (ChirpPage, error) {
+	clauses, err := parseSearch(query.Query)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	c, err := query.decodeCursor()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	schema := &db.schema
+
+	hits := schema.search.search(clauses, func(id int) bool {
+		chirp := schema.Chirps[id]
+		return (query.AuthorID == 0 || chirp.AuthorID == query.AuthorID) && !schema.hidden(chirp)
+	})
+
+	if c != nil {
+		after := searchHit{id: c.ID, score: c.Score}
+		start := sort.Search(len(hits), func(i int) bool {
+			return after.before(hits[i])
+		})
+		hits = hits[start:]
+	}
+
+	page := ChirpPage{Chirps: []Chirp{}}
+	if query.Limit > 0 && len(hits) > query.Limit {
+		hits = hits[:query.Limit]
+		last := hits[query.Limit-1]
+		page.NextCursor = query.nextCursor(last.score, last.id)
+	}
+
+	for _, hit := range hits {
+		page.Chirps = append(page.Chirps, schema.Chirps[hit.id])
+	}
+
+	return page, nil
+}
+
+func (db *DB) ReadChirp(chirpID int) (Chirp, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	schema := &db.schema
+
+	chirp, ok := schema.Chirps[chirpID]
+	if !ok || schema.hidden(chirp) {
+		return Chirp{}, nil
+	}
+
+	return chirp, nil
+}
+
+func (db *DB) CreateChirp(authorID int, body string) (Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.addChirp(Chirp{
+		AuthorID: authorID,
+		Body:     body,
+	})
+}
+
+// addChirp gives chirp an ID and timestamps and saves it. The caller must
+// hold the write lock.
+func (db *DB) addChirp(chirp Chirp, changes ...change) (Chirp, error) {
+	schema := &db.schema
+
+	id, sequence := db.nextID(schema, "chirps")
+	now := time.Now().UTC()
+	chirp.ID = id
+	chirp.Entities = schema.entities(chirp.Body)
+	chirp.CreatedAt = now
+	chirp.UpdatedAt = now
+
+	schema.putChirp(chirp)
+
+	changes = append([]change{sequence, putChange("chirps", chirp.ID, chirp)}, changes...)
+	err := db.commit(changes...)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+func (db *DB) CreateReply(authorID int, inReplyTo int, body string) (Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	parent, ok := schema.Chirps[inReplyTo]
+	if !ok || schema.hidden(parent) {
+		return Chirp{}, ErrChirpNotFound
+	}
+
+	return db.addChirp(Chirp{
+		AuthorID:  authorID,
+		Body:      body,
+		InReplyTo: parent.ID,
+		RootID:    parent.root(),
+	})
+}
+
+// root returns the ID of the chirp that started chirp's conversation.
+func (chirp Chirp) root() int {
+	if chirp.RootID != 0 {
+		return chirp.RootID
+	}
+	return chirp.ID
+}
+
+func (db *DB) CreateQuote(authorID int, quoteOf int, body string) (Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	original, ok := schema.Chirps[quoteOf]
+	if !ok || schema.hidden(original) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	original = schema.original(original)
+	if schema.hidden(original) {
+		return Chirp{}, ErrChirpNotFound
+	}
+
+	original.QuoteCount++
+	schema.putChirp(original)
+
+	return db.addChirp(Chirp{
+		AuthorID: authorID,
+		Body:     body,
+		QuoteOf:  original.ID,
+	}, putChange("chirps", original.ID, original))
+}
+
+// Rechirp reposts chirpID for userID. Rechirping the same chirp twice
+// returns the existing rechirp.
+func (db *DB) Rechirp(userID int, chirpID int) (Chirp, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	original, ok := schema.Chirps[chirpID]
+	if !ok || schema.hidden(original) {
+		return Chirp{}, false, ErrChirpNotFound
+	}
+	original = schema.original(original)
+	if schema.hidden(original) {
+		return Chirp{}, false, ErrChirpNotFound
+	}
+
+	rechirp, ok := schema.findRechirp(original.ID, userID)
+	if ok {
+		return rechirp, false, nil
+	}
+
+	original.RechirpCount++
+	schema.putChirp(original)
+
+	rechirp, err := db.addChirp(Chirp{
+		AuthorID:  userID,
+		RechirpOf: original.ID,
+	}, putChange("chirps", original.ID, original))
+	if err != nil {
+		return Chirp{}, false, err
+	}
+	return rechirp, true, nil
+}
+
+// Unrechirp removes userID's rechirp of chirpID.
+func (db *DB) Unrechirp(userID int, chirpID int) (Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	rechirp, ok := schema.findRechirp(chirpID, userID)
+	if !ok {
+		return Chirp{}, ErrChirpNotFound
+	}
+
+	changes := []change{deleteChange("chirps", rechirp.ID)}
+	changes = append(changes, schema.uncount(rechirp)...)
+	schema.removeChirp(rechirp.ID)
+
+	err := db.commit(changes...)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, err
+	}
+
+	return rechirp, nil
 }
 
-type Chirp struct {
-	ID       int    `json:"id"`
-	AuthorID int    `json:"author_id"`
-	Body     string `json:"body"`
+func (db *DB) UpdateChirp(authorID int, chirpID int, body string) (Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	chirp, ok := schema.Chirps[chirpID]
+	if !ok {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if chirp.AuthorID != authorID {
+		return Chirp{}, ErrNotAuthor
+	}
+	if chirp.RechirpOf != 0 {
+		return Chirp{}, ErrRechirp
+	}
+	if chirp.Body == body {
+		return chirp, nil
+	}
+
+	id, sequence := db.nextID(schema, "revisions")
+	revision := Revision{
+		ID:        id,
+		ChirpID:   chirp.ID,
+		Body:      chirp.Body,
+		CreatedAt: chirp.UpdatedAt,
+	}
+
+	chirp.Body = body
+	chirp.Entities = schema.entities(body)
+	chirp.Edited = true
+	chirp.UpdatedAt = time.Now().UTC()
+
+	schema.putRevision(revision)
+	schema.putChirp(chirp)
+
+	err := db.commit(sequence, putChange("revisions", revision.ID, revision), putChange("chirps", chirp.ID, chirp))
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+func (db *DB) DeleteChirp(authorID int, chirpID int) (Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	chirp, ok := schema.Chirps[chirpID]
+	if !ok {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if chirp.AuthorID != authorID {
+		return Chirp{}, ErrNotAuthor
+	}
+
+	changes := schema.deleteChirp(chirp)
+
+	err := db.commit(changes...)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+func (db *DB) Trending(query TrendingQuery) ([]TrendingTag, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.schema.trends.top(query, time.Now())
+}
+
+// setTrendingWindows recounts the trends over windows.
+func (db *DB) setTrendingWindows(windows []time.Duration) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	trends := newTrendTracker(windows)
+	for _, chirp := range db.schema.Chirps {
+		trends.addChirp(chirp)
+	}
+	db.schema.trends = trends
+}
+
+func (db *DB) ListRevisions(chirpID int) ([]Revision, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	schema := &db.schema
+
+	chirp, ok := schema.Chirps[chirpID]
+	if !ok || schema.hidden(chirp) {
+		return nil, ErrChirpNotFound
+	}
+
+	return schema.revisionsFor(chirpID), nil
+}
+
+// LikeChirp likes chirpID for userID, liking a chirp twice changes nothing.
+// Likes of a rechirp go to the chirp it reposts.
+func (db *DB) LikeChirp(userID int, chirpID int) (Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	chirp, ok := schema.Chirps[chirpID]
+	if !ok || schema.hidden(chirp) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	chirp = schema.original(chirp)
+	if schema.hidden(chirp) {
+		return Chirp{}, ErrChirpNotFound
+	}
+
+	_, ok = schema.likesByUser[userID][chirp.ID]
+	if ok {
+		return chirp, nil
+	}
+
+	id, sequence := db.nextID(schema, "likes")
+	like := Like{
+		ID:        id,
+		UserID:    userID,
+		ChirpID:   chirp.ID,
+		CreatedAt: time.Now().UTC(),
+	}
+	chirp.LikeCount++
+
+	schema.putLike(like)
+	schema.putChirp(chirp)
+
+	err := db.commit(sequence, putChange("likes", like.ID, like), putChange("chirps", chirp.ID, chirp))
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// UnlikeChirp takes back userID's like of chirpID, if there is one.
+func (db *DB) UnlikeChirp(userID int, chirpID int) (Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	chirp, ok := schema.Chirps[chirpID]
+	if !ok {
+		return Chirp{}, ErrChirpNotFound
+	}
+	chirp = schema.original(chirp)
+
+	id, ok := schema.likesByUser[userID][chirp.ID]
+	if !ok {
+		return chirp, nil
+	}
+
+	chirp.LikeCount--
+
+	schema.removeLike(id)
+	schema.putChirp(chirp)
+
+	err := db.commit(deleteChange("likes", id), putChange("chirps", chirp.ID, chirp))
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// LikedChirps reports which of chirpIDs userID has liked.
+func (db *DB) LikedChirps(userID int, chirpIDs []int) (map[int]bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	schema := &db.schema
+
+	liked := map[int]bool{}
+	for _, chirpID := range chirpIDs {
+		_, ok := schema.likesByUser[userID][chirpID]
+		if ok {
+			liked[chirpID] = true
+		}
+	}
+
+	return liked, nil
+}
+
+func (db *DB) ListLikes(query LikeQuery) (ChirpPage, error) {
+	c, err := query.decodeCursor()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	schema := &db.schema
+
+	likeIDs := []int{}
+	for chirpID, id := range schema.likesByUser[query.UserID] {
+		if schema.hidden(schema.Chirps[chirpID]) {
+			continue
+		}
+		if c == nil || id < c.LikeID {
+			likeIDs = append(likeIDs, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(likeIDs)))
+
+	page := ChirpPage{Chirps: []Chirp{}}
+	if query.Limit > 0 && len(likeIDs) > query.Limit {
+		likeIDs = likeIDs[:query.Limit]
+		page.NextCursor = query.nextCursor(likeIDs[query.Limit-1])
+	}
+
+	for _, id := range likeIDs {
+		page.Chirps = append(page.Chirps, schema.Chirps[schema.Likes[id].ChirpID])
+	}
+
+	return page, nil
+}
+
+// Follow makes followerID follow followeeID, following twice changes
+// nothing.
+func (db *DB) Follow(followerID int, followeeID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	if followerID == followeeID {
+		return ErrFollowSelf
+	}
+	_, err := schema.findUserById(followeeID)
+	if err != nil {
+		return err
+	}
+	if schema.deleted(followeeID) {
+		return ErrUserNotFound
+	}
+
+	_, ok := schema.following[followerID][followeeID]
+	if ok {
+		return nil
+	}
+
+	id, sequence := db.nextID(schema, "follows")
+	follow := Follow{
+		ID:         id,
+		FollowerID: followerID,
+		FolloweeID: followeeID,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	schema.putFollow(follow)
+
+	err = db.commit(sequence, putChange("follows", follow.ID, follow))
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// Unfollow stops followerID following followeeID, if it does.
+func (db *DB) Unfollow(followerID int, followeeID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	id, ok := schema.following[followerID][followeeID]
+	if !ok {
+		return nil
+	}
+
+	schema.removeFollow(id)
+
+	err := db.commit(deleteChange("follows", id))
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+func (db *DB) ListFollowers(query FollowQuery) (UserPage, error) {
+	return db.listFollows(query, "followers")
+}
+
+func (db *DB) ListFollowing(query FollowQuery) (UserPage, error) {
+	return db.listFollows(query, "following")
+}
+
+// listFollows pages through one side of the follow graph around
+// query.UserID.
+func (db *DB) listFollows(query FollowQuery, list string) (UserPage, error) {
+	c, err := query.decodeCursor(list)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	schema := &db.schema
+
+	follows := schema.following[query.UserID]
+	if list == "followers" {
+		follows = schema.followers[query.UserID]
+	}
+
+	followIDs := []int{}
+	for userID, id := range follows {
+		if schema.deleted(userID) {
+			continue
+		}
+		if c == nil || id < c.FollowID {
+			followIDs = append(followIDs, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(followIDs)))
+
+	page := UserPage{Users: []User{}}
+	if query.Limit > 0 && len(followIDs) > query.Limit {
+		followIDs = followIDs[:query.Limit]
+		page.NextCursor = query.nextCursor(list, followIDs[query.Limit-1])
+	}
+
+	for _, id := range followIDs {
+		follow := schema.Follows[id]
+
+		user := schema.Users[follow.FolloweeID]
+		if list == "followers" {
+			user = schema.Users[follow.FollowerID]
+		}
+		user.Password = ""
+		page.Users = append(page.Users, user)
+	}
+
+	return page, nil
+}
+
+// Timeline merges the chirps of everyone query.UserID follows. Each
+// author's chirps are already in ID order, so only the newest few of each
+// are looked at rather than every chirp.
+func (db *DB) Timeline(query TimelineQuery) (ChirpPage, error) {
+	c, err := query.decodeCursor()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	schema := &db.schema
+
+	authorIDs := []int{}
+	for followeeID := range schema.following[query.UserID] {
+		if !schema.deleted(followeeID) {
+			authorIDs = append(authorIDs, followeeID)
+		}
+	}
+
+	beforeID := 0
+	if c != nil {
+		beforeID = c.ID
+	}
+
+	limit := query.Limit
+	if limit > 0 {
+		limit++
+	}
+
+	page := ChirpPage{Chirps: schema.timeline(authorIDs, beforeID, limit)}
+	if query.Limit > 0 && len(page.Chirps) > query.Limit {
+		page.Chirps = page.Chirps[:query.Limit]
+		page.NextCursor = query.nextCursor(page.Chirps[query.Limit-1].ID)
+	}
+
+	return page, nil
 }
 
-type User struct {
-	ID          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"password,omitempty"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
-}
+func (db *DB) CreateUser(email string, password string) (User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-type Schema struct {
-	Chirps        map[int]Chirp   `json:"chirps"`
-	Users         map[int]User    `json:"users"`
-	RefreshTokens map[string]bool `json:"refresh_tokens"`
-}
+	schema := &db.schema
 
-func NewDB() DB {
-	dbg := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
+	user, err := schema.findUserByEmail(email)
+	if err == nil {
+		return User{}, errors.New("user email already exists")
+	}
 
-	// Clear db if exists
-	if *dbg {
-		os.Remove(dbFile)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+	if err != nil {
+		return User{}, errors.New("problem saving password")
 	}
 
-	return DB{
-		mu: &sync.RWMutex{},
+	id, sequence := db.nextID(schema, "users")
+	now := time.Now().UTC()
+	user = User{
+		ID:          id,
+		Email:       email,
+		Password:    string(hash),
+		IsChirpyRed: false,
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
-}
 
-func (db *DB) ListChirps(authorID int, sortDesc bool) ([]Chirp, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+	schema.putUser(user)
 
-	schema, err := readDB()
+	err = db.commit(sequence, putChange("users", user.ID, user))
 	if err != nil {
 		log.Println(err)
-		return []Chirp{}, err
+		return User{}, err
 	}
 
-	chirpList := []Chirp{}
-	for _, chirp := range schema.Chirps {
-		if authorID == 0 || chirp.AuthorID == authorID {
-			chirpList = append(chirpList, chirp)
-		}
+	user.Password = ""
+	return user, nil
+}
+
+func (db *DB) UpdateUser(userId int, email string, password string) (User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	user, err := schema.findUserById(userId)
+	if err != nil {
+		return User{}, ErrUserNotFound
 	}
 
-	sort.Slice(chirpList, func(i, j int) bool {
-		if sortDesc {
-			return chirpList[i].ID > chirpList[j].ID
-		} else {
-			return chirpList[i].ID < chirpList[j].ID
-		}
-	})
+	existing, err := schema.findUserByEmail(email)
+	if err == nil && existing.ID != user.ID {
+		return User{}, errors.New("user email already exists")
+	}
 
-	return chirpList, nil
-}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+	if err != nil {
+		return User{}, errors.New("problem saving password")
+	}
 
-func (db *DB) ReadChirp(chirpID int) (Chirp, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+	user.Email = email
+	user.Password = string(hash)
+	user.UpdatedAt = time.Now().UTC()
+
+	schema.putUser(user)
 
-	schema, err := readDB()
+	err = db.commit(putChange("users", user.ID, user))
 	if err != nil {
 		log.Println(err)
-		return Chirp{}, err
+		return User{}, err
 	}
 
-	chirp, ok := schema.Chirps[chirpID]
-	if !ok {
-		return Chirp{}, nil
+	user.Password = ""
+	return user, nil
+}
+
+func (db *DB) ReadUser(userID int) (User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	user, err := db.schema.findUserById(userID)
+	if err != nil {
+		return User{}, err
 	}
 
-	return chirp, nil
+	user.Password = ""
+	return user, nil
 }
 
-func (db *DB) CreateChirp(authorID int, body string) (Chirp, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+func (db *DB) ReadUserByHandle(handle string) (User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
-	schema, err := readDB()
+	user, err := db.schema.findUserByHandle(handle)
 	if err != nil {
-		log.Println(err)
-		return Chirp{}, err
+		return User{}, err
 	}
 
-	chirp := Chirp{
-		ID:       len(schema.Chirps) + 1,
-		AuthorID: authorID,
-		Body:     body,
-	}
+	user.Password = ""
+	return user, nil
+}
 
-	schema.Chirps[chirp.ID] = chirp
+// ReadUsers looks up each of userIDs, leaving out those that don't exist.
+func (db *DB) ReadUsers(userIDs []int) (map[int]User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
-	err = saveDB(schema)
-	if err != nil {
-		log.Println(err)
-		return Chirp{}, err
+	users := map[int]User{}
+	for _, id := range userIDs {
+		user, ok := db.schema.Users[id]
+		if ok {
+			user.Password = ""
+			users[id] = user
+		}
 	}
 
-	return chirp, nil
+	return users, nil
 }
 
-func (db *DB) DeleteChirp(authorID int, chirpID int) (Chirp, error) {
+func (db *DB) UpdateProfile(userID int, update ProfileUpdate) (User, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	schema, err := readDB()
+	schema := &db.schema
+
+	user, err := schema.findUserById(userID)
 	if err != nil {
-		log.Println(err)
-		return Chirp{}, err
+		return User{}, ErrUserNotFound
 	}
 
-	chirp, ok := schema.Chirps[chirpID]
-	if !ok {
-		return Chirp{}, errors.New("chirp does not exist")
-	}
-	if chirp.AuthorID != authorID {
-		return Chirp{}, errors.New("invalid author")
+	user = update.apply(user)
+	if user.Handle != "" {
+		existing, err := schema.findUserByHandle(user.Handle)
+		if err == nil && existing.ID != user.ID {
+			return User{}, ErrHandleTaken
+		}
 	}
+	user.UpdatedAt = time.Now().UTC()
 
-	delete(schema.Chirps, chirpID)
+	schema.putUser(user)
 
-	err = saveDB(schema)
+	err = db.commit(putChange("users", user.ID, user))
 	if err != nil {
 		log.Println(err)
-		return Chirp{}, err
+		return User{}, err
 	}
 
-	return chirp, nil
+	user.Password = ""
+	return user, nil
 }
 
-func (db *DB) CreateUser(email string, password string) (User, error) {
+// DeleteUser soft-deletes an account: its refresh tokens are revoked and its
+// chirps hidden until PurgeDeletedUsers removes it for good or RestoreUser
+// brings it back.
+func (db *DB) DeleteUser(userID int) (User, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	schema, err := readDB()
+	schema := &db.schema
+
+	user, err := schema.findUserById(userID)
 	if err != nil {
-		log.Println(err)
-		return User{}, err
+		return User{}, ErrUserNotFound
 	}
-
-	user, err := findUserByEmail(schema.Users, email)
-	if err == nil {
-		return User{}, errors.New("user email already exists")
+	if user.DeletedAt != nil {
+		user.Password = ""
+		return user, nil
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
-	if err != nil {
-		return User{}, errors.New("problem saving password")
-	}
+	changes := schema.endSessions(user.ID)
 
-	user = User{
-		ID:          len(schema.Users) + 1,
-		Email:       email,
-		Password:    string(hash),
-		IsChirpyRed: false,
+	for _, chirp := range schema.chirpsFor(user.ID) {
+		schema.trends.removeChirp(chirp)
 	}
 
-	schema.Users[user.ID] = user
+	now := time.Now().UTC()
+	user.DeletedAt = &now
+	user.UpdatedAt = now
+	schema.putUser(user)
 
-	err = saveDB(schema)
+	err = db.commit(append(changes, putChange("users", user.ID, user))...)
 	if err != nil {
 		log.Println(err)
 		return User{}, err
@@ -192,70 +1235,94 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 	return user, nil
 }
 
-func (db *DB) UpdateUser(userId int, email string, password string) (User, error) {
+// RestoreUser undoes DeleteUser for the account with these credentials,
+// as long as it hasn't been purged yet. Revoked tokens stay revoked.
+func (db *DB) RestoreUser(email string, password string) (User, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	schema, err := readDB()
+	schema := &db.schema
+
+	user, err := schema.findUserByEmail(email)
 	if err != nil {
-		log.Println(err)
 		return User{}, err
 	}
 
-	user, err := findUserById(schema.Users, userId)
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	if err != nil {
-		return User{}, errors.New("user does not exist")
+		return User{}, errors.New("incorrect credentials")
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
-	if err != nil {
-		return User{}, errors.New("problem saving password")
+	if user.DeletedAt != nil {
+		user.DeletedAt = nil
+		user.UpdatedAt = time.Now().UTC()
+		schema.putUser(user)
+
+		for _, chirp := range schema.chirpsFor(user.ID) {
+			schema.trends.addChirp(chirp)
+		}
+
+		err = db.commit(putChange("users", user.ID, user))
+		if err != nil {
+			log.Println(err)
+			return User{}, err
+		}
 	}
 
-	user = User{
-		ID:          user.ID,
-		Email:       email,
-		Password:    string(hash),
-		IsChirpyRed: user.IsChirpyRed,
+	user.Password = ""
+	return user, nil
+}
+
+// PurgeDeletedUsers removes the accounts deleted before before along with
+// their chirps, likes, follows and refresh tokens. Replies and quotes by
+// others stay, as with DeleteChirp.
+func (db *DB) PurgeDeletedUsers(before time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	changes := []change{}
+	purged := 0
+	for _, user := range schema.Users {
+		if user.DeletedAt == nil || !user.DeletedAt.Before(before) {
+			continue
+		}
+
+		changes = append(changes, schema.purgeUser(user)...)
+		purged++
 	}
 
-	schema.Users[user.ID] = user
+	if purged == 0 {
+		return 0, nil
+	}
 
-	err = saveDB(schema)
+	err := db.commit(changes...)
 	if err != nil {
 		log.Println(err)
-		return User{}, err
+		return 0, err
 	}
 
-	user.Password = ""
-	return user, nil
+	return purged, nil
 }
 
 func (db *DB) ActivateChirpyRed(userId int) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	schema, err := readDB()
-	if err != nil {
-		log.Println(err)
-		return err
-	}
+	schema := &db.schema
 
-	user, err := findUserById(schema.Users, userId)
+	user, err := schema.findUserById(userId)
 	if err != nil {
-		return errors.New("user does not exist")
+		return ErrUserNotFound
 	}
 
-	user = User{
-		ID:          user.ID,
-		Email:       user.Email,
-		Password:    user.Password,
-		IsChirpyRed: true,
-	}
+	user.IsChirpyRed = true
+	user.UpdatedAt = time.Now().UTC()
 
-	schema.Users[user.ID] = user
+	schema.putUser(user)
 
-	err = saveDB(schema)
+	err = db.commit(putChange("users", user.ID, user))
 	if err != nil {
 		log.Println(err)
 		return err
@@ -268,13 +1335,9 @@ func (db *DB) Login(email string, password string) (User, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	schema, err := readDB()
-	if err != nil {
-		log.Println(err)
-		return User{}, err
-	}
+	schema := &db.schema
 
-	user, err := findUserByEmail(schema.Users, email)
+	user, err := schema.findUserByEmail(email)
 	if err != nil {
 		return User{}, err
 	}
@@ -288,58 +1351,134 @@ func (db *DB) Login(email string, password string) (User, error) {
 	return user, nil
 }
 
-func (db *DB) SaveRefreshToken(token string) error {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// SaveRefreshToken starts a session on device with token as its first
+// refresh token, lasting until expiresAt unless it is refreshed.
+func (db *DB) SaveRefreshToken(userID int, token string, device Device, expiresAt time.Time) (Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	schema, err := readDB()
+	schema := &db.schema
+
+	family, err := newTokenFamily()
 	if err != nil {
-		log.Println(err)
-		return err
+		return Session{}, err
 	}
 
-	schema.RefreshTokens[token] = false
+	now := time.Now().UTC()
+	session := Session{ID: family, UserID: userID, CreatedAt: now}.use(device, now, expiresAt)
+	schema.putSession(session)
+
+	refreshToken := RefreshToken{UserID: userID, Family: family, ExpiresAt: expiresAt.UTC()}
+	schema.putRefreshToken(token, refreshToken)
 
-	err = saveDB(schema)
+	err = db.commit(
+		putChange("sessions", session.ID, session),
+		putChange("refresh_tokens", token, refreshToken),
+	)
 	if err != nil {
 		log.Println(err)
-		return err
+		return Session{}, err
 	}
 
-	return nil
+	return session, nil
 }
 
 func (db *DB) CheckRefreshToken(token string) bool {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	schema, err := readDB()
-	if err != nil {
-		log.Println(err)
-		return false
-	}
+	schema := &db.schema
 
-	revoked, ok := schema.RefreshTokens[token]
-	if revoked || !ok {
+	refreshToken, ok := schema.RefreshTokens[token]
+	if refreshToken.Revoked || refreshToken.Rotated || refreshToken.expired(time.Now()) || !ok {
 		return false
 	} else {
 		return true
 	}
 }
 
-func (db *DB) RevokeRefreshToken(token string) error {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// RotateRefreshToken exchanges token for next, which joins its family, and
+// records that its session was used from device. If token was already
+// rotated its session is ended and ErrRefreshTokenReused is returned along
+// with it.
+func (db *DB) RotateRefreshToken(token string, next string, device Device, expiresAt time.Time) (RefreshToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
 
-	schema, err := readDB()
+	refreshToken, ok := schema.RefreshTokens[token]
+	if !ok {
+		return RefreshToken{}, ErrInvalidRefreshToken
+	}
+
+	if refreshToken.Rotated {
+		err := db.commit(schema.endSession(refreshToken.UserID, refreshToken.Family)...)
+		if err != nil {
+			log.Println(err)
+			return RefreshToken{}, err
+		}
+		return refreshToken, ErrRefreshTokenReused
+	}
+	if refreshToken.Revoked || refreshToken.expired(time.Now()) {
+		return RefreshToken{}, ErrInvalidRefreshToken
+	}
+
+	if refreshToken.Family == "" {
+		family, err := newTokenFamily()
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		refreshToken.Family = family
+	}
+	refreshToken.Rotated = true
+	schema.putRefreshToken(token, refreshToken)
+
+	nextToken := RefreshToken{UserID: refreshToken.UserID, Family: refreshToken.Family, ExpiresAt: expiresAt.UTC()}
+	schema.putRefreshToken(next, nextToken)
+
+	// Tokens from before sessions were recorded start one here
+	now := time.Now().UTC()
+	session, ok := schema.Sessions[refreshToken.Family]
+	if !ok {
+		session = Session{ID: refreshToken.Family, UserID: refreshToken.UserID, CreatedAt: now}
+	}
+	session = session.use(device, now, expiresAt)
+	schema.putSession(session)
+
+	err := db.commit(
+		putChange("refresh_tokens", token, refreshToken),
+		putChange("refresh_tokens", next, nextToken),
+		putChange("sessions", session.ID, session),
+	)
 	if err != nil {
 		log.Println(err)
-		return err
+		return RefreshToken{}, err
+	}
+
+	return nextToken, nil
+}
+
+// RevokeRefreshToken revokes token and ends the session it belongs to.
+func (db *DB) RevokeRefreshToken(token string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	refreshToken, ok := schema.RefreshTokens[token]
+	if !ok {
+		return nil
 	}
+	refreshToken.Revoked = true
+	schema.putRefreshToken(token, refreshToken)
 
-	schema.RefreshTokens[token] = true
+	changes := []change{putChange("refresh_tokens", token, refreshToken)}
+	if refreshToken.Family != "" {
+		changes = append(changes, schema.endSession(refreshToken.UserID, refreshToken.Family)...)
+	}
 
-	err = saveDB(schema)
+	err := db.commit(changes...)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -348,63 +1487,142 @@ func (db *DB) RevokeRefreshToken(token string) error {
 	return nil
 }
 
-func findUserByEmail(users map[int]User, email string) (User, error) {
-	for _, user := range users {
-		if user.Email == email {
-			return user, nil
+// PurgeExpiredTokens removes refresh tokens that expired or were revoked
+// by now, and the sessions that expired with them. Rotated tokens are kept
+// until they expire so reusing them is still caught.
+func (db *DB) PurgeExpiredTokens(now time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	changes := []change{}
+	for token, refreshToken := range schema.RefreshTokens {
+		if refreshToken.Revoked || refreshToken.expired(now) {
+			schema.removeRefreshToken(token)
+			changes = append(changes, deleteChange("refresh_tokens", token))
+		}
+	}
+	purged := len(changes)
+
+	for id, session := range schema.Sessions {
+		if session.expired(now) {
+			schema.removeSession(id)
+			changes = append(changes, deleteChange("sessions", id))
 		}
 	}
 
-	return User{}, errors.New("user does not exist")
+	err := db.commit(changes...)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	return purged, nil
 }
 
-func findUserById(users map[int]User, id int) (User, error) {
-	for _, user := range users {
-		if user.ID == id {
-			return user, nil
+// ListSessions returns userID's live sessions, most recently used first.
+func (db *DB) ListSessions(userID int) ([]Session, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	schema := &db.schema
+
+	now := time.Now()
+	sessions := []Session{}
+	for id := range schema.sessionsByUser[userID] {
+		session := schema.Sessions[id]
+		if !session.expired(now) {
+			sessions = append(sessions, session)
 		}
 	}
+	sortSessions(sessions)
 
-	return User{}, errors.New("user does not exist")
+	return sessions, nil
 }
 
-func readDB() (Schema, error) {
-	_, err := os.Stat(dbFile)
-	if err != nil {
-		return Schema{
-			Chirps:        map[int]Chirp{},
-			Users:         map[int]User{},
-			RefreshTokens: map[string]bool{},
-		}, nil
+// CountLiveSessions returns how many sessions can still be refreshed.
+func (db *DB) CountLiveSessions() (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now()
+	live := 0
+	for _, session := range db.schema.Sessions {
+		if !session.expired(now) {
+			live++
+		}
 	}
 
-	data, err := os.ReadFile(dbFile)
-	if err != nil {
-		return Schema{}, errors.New("could not read database")
+	return live, nil
+}
+
+// RevokeSession ends one of userID's sessions.
+func (db *DB) RevokeSession(userID int, sessionID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	schema := &db.schema
+
+	session, ok := schema.Sessions[sessionID]
+	if !ok || session.UserID != userID {
+		return ErrSessionNotFound
 	}
 
-	schema := Schema{}
-	err = json.Unmarshal(data, &schema)
+	err := db.commit(schema.endSession(userID, sessionID)...)
 	if err != nil {
-		return schema, errors.New("could not parse json")
+		log.Println(err)
+		return err
 	}
 
-	return schema, nil
+	return nil
 }
 
-func saveDB(schema Schema) error {
-	file, err := os.Create(dbFile)
-	if err != nil {
-		return errors.New("could not create the database file")
-	}
-	defer file.Close()
+// RevokeSessions logs userID out everywhere.
+func (db *DB) RevokeSessions(userID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	encoder := json.NewEncoder(file)
+	schema := &db.schema
 
-	err = encoder.Encode(schema)
+	err := db.commit(schema.endSessions(userID)...)
 	if err != nil {
-		return errors.New("there was a problem saving the list")
+		log.Println(err)
+		return err
 	}
 
 	return nil
 }
+
+// less orders chirps by the query's sort field, falling back to ID so the
+// order is stable when timestamps tie.
+func (query ChirpQuery) less(a Chirp, b Chirp) bool {
+	if query.SortBy == SortByCreatedAt && !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+
+	return a.ID < b.ID
+}
+
+func (query ChirpQuery) matches(chirp Chirp) bool {
+	if query.AuthorID != 0 && chirp.AuthorID != query.AuthorID {
+		return false
+	}
+	if query.InReplyTo != 0 && chirp.InReplyTo != query.InReplyTo {
+		return false
+	}
+	if query.Hashtag != "" && !slices.Contains(hashtags(chirp.Entities), HashtagKey(query.Hashtag)) {
+		return false
+	}
+	if query.Mentions != 0 && !slices.Contains(mentions(chirp.Entities), query.Mentions) {
+		return false
+	}
+	if query.AfterID != 0 && chirp.ID <= query.AfterID {
+		return false
+	}
+	if query.BeforeID != 0 && chirp.ID >= query.BeforeID {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,722 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// forEachStore runs fn against a fresh instance of every Store backend.
+func forEachStore(t *testing.T, fn func(t *testing.T, db Store)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryDB())
+	})
+
+	t.Run("json", func(t *testing.T) {
+		fn(t, newTestDB(t, filepath.Join(t.TempDir(), "database.json")))
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		fn(t, newTestSQLiteDB(t))
+	})
+}
+
+func newTestDB(t testing.TB, path string) *DB {
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return db
+}
+
+func newTestSQLiteDB(t testing.TB) *SQLiteDB {
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = sqliteMigrator{db: db.db}.MigrateUp()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return db
+}
+
+func TestStoreChirps(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		first, err := db.CreateChirp(1, "first")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, err = db.CreateChirp(2, "second")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		chirp, err := db.ReadChirp(first.ID)
+		if err != nil || !reflect.DeepEqual(chirp, first) {
+			t.Errorf("Expected '%v' but got '%v' (%v)", first, chirp, err)
+		}
+
+		page, err := db.ListChirps(ChirpQuery{AuthorID: 2})
+		chirps := page.Chirps
+		if err != nil || len(chirps) != 1 || chirps[0].Body != "second" {
+			t.Errorf("Expected only the second chirp but got '%v' (%v)", chirps, err)
+		}
+
+		_, err = db.DeleteChirp(2, first.ID)
+		if err == nil {
+			t.Errorf("Expected deleting another author's chirp to fail")
+		}
+
+		_, err = db.DeleteChirp(1, first.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		page, _ = db.ListChirps(ChirpQuery{})
+		chirps = page.Chirps
+		if len(chirps) != 1 {
+			t.Errorf("Expected 1 chirp but got %v", len(chirps))
+		}
+	})
+}
+
+func TestUpdateChirp(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		original, _ := db.CreateChirp(1, "frist")
+		db.CreateChirp(1, "other")
+
+		_, err := db.UpdateChirp(2, original.ID, "first")
+		if err != ErrNotAuthor {
+			t.Errorf("Expected editing another author's chirp to fail but got %v", err)
+		}
+		_, err = db.UpdateChirp(1, 99, "first")
+		if err != ErrChirpNotFound {
+			t.Errorf("Expected editing a missing chirp to fail but got %v", err)
+		}
+
+		db.UpdateChirp(1, original.ID, "first")
+		chirp, err := db.UpdateChirp(1, original.ID, "first!")
+		if err != nil || chirp.Body != "first!" || !chirp.Edited {
+			t.Fatalf("Expected an edited chirp but got '%v' (%v)", chirp, err)
+		}
+
+		read, _ := db.ReadChirp(original.ID)
+		if !reflect.DeepEqual(read, chirp) {
+			t.Errorf("Expected '%v' but got '%v'", chirp, read)
+		}
+
+		revisions, err := db.ListRevisions(original.ID)
+		if err != nil || len(revisions) != 2 || revisions[0].Body != "frist" || revisions[1].Body != "first" {
+			t.Fatalf("Expected the two earlier bodies but got '%v' (%v)", revisions, err)
+		}
+		if !revisions[0].CreatedAt.Equal(original.CreatedAt) {
+			t.Errorf("Expected the first revision to date from %v but got %v", original.CreatedAt, revisions[0].CreatedAt)
+		}
+
+		page, _ := db.SearchChirps(SearchQuery{Query: "frist"})
+		if len(page.Chirps) != 0 {
+			t.Errorf("Expected the old body to be gone from search but got %v", chirpIDs(page.Chirps))
+		}
+
+		db.DeleteChirp(1, original.ID)
+		_, err = db.ListRevisions(original.ID)
+		if err != ErrChirpNotFound {
+			t.Errorf("Expected revisions of a deleted chirp to be gone but got %v", err)
+		}
+	})
+}
+
+func TestCreateReply(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		root, _ := db.CreateChirp(1, "root")
+		reply, err := db.CreateReply(2, root.ID, "reply")
+		if err != nil || reply.InReplyTo != root.ID || reply.RootID != root.ID {
+			t.Fatalf("Expected a reply to %v but got '%v' (%v)", root.ID, reply, err)
+		}
+
+		nested, _ := db.CreateReply(1, reply.ID, "nested")
+		if nested.InReplyTo != reply.ID || nested.RootID != root.ID {
+			t.Errorf("Expected a reply to %v in %v's thread but got '%v'", reply.ID, root.ID, nested)
+		}
+		db.CreateReply(3, root.ID, "another reply")
+
+		page, _ := db.ListChirps(ChirpQuery{InReplyTo: root.ID})
+		if chirpIDs(page.Chirps) != "[2 4]" {
+			t.Errorf("Expected the direct replies [2 4] but got %v", chirpIDs(page.Chirps))
+		}
+
+		_, err = db.CreateReply(1, 99, "reply")
+		if err != ErrChirpNotFound {
+			t.Errorf("Expected replying to a missing chirp to fail but got %v", err)
+		}
+
+		// Replies survive the chirp they answer
+		db.DeleteChirp(2, reply.ID)
+		read, _ := db.ReadChirp(nested.ID)
+		if read.InReplyTo != reply.ID {
+			t.Errorf("Expected the nested reply to remain but got '%v'", read)
+		}
+	})
+}
+
+func TestRechirpsAndQuotes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		original, _ := db.CreateChirp(1, "original")
+
+		rechirp, created, err := db.Rechirp(2, original.ID)
+		if err != nil || !created || rechirp.RechirpOf != original.ID || rechirp.Body != "" {
+			t.Fatalf("Expected a rechirp of %v but got '%v' (%v)", original.ID, rechirp, err)
+		}
+
+		again, created, _ := db.Rechirp(2, original.ID)
+		if again.ID != rechirp.ID || created {
+			t.Errorf("Expected rechirping twice to return %v but got %v", rechirp.ID, again.ID)
+		}
+
+		// Rechirping a rechirp reposts the original
+		other, _, _ := db.Rechirp(3, rechirp.ID)
+		if other.RechirpOf != original.ID {
+			t.Errorf("Expected a rechirp of %v but got '%v'", original.ID, other)
+		}
+
+		quote, err := db.CreateQuote(3, rechirp.ID, "look")
+		if err != nil || quote.QuoteOf != original.ID {
+			t.Fatalf("Expected a quote of %v but got '%v' (%v)", original.ID, quote, err)
+		}
+
+		read, _ := db.ReadChirp(original.ID)
+		if read.RechirpCount != 2 || read.QuoteCount != 1 {
+			t.Errorf("Expected 2 rechirps and 1 quote but got '%v'", read)
+		}
+
+		_, err = db.UpdateChirp(2, rechirp.ID, "edited")
+		if err != ErrRechirp {
+			t.Errorf("Expected editing a rechirp to fail but got %v", err)
+		}
+
+		db.Unrechirp(3, original.ID)
+		_, err = db.Unrechirp(3, original.ID)
+		if err != ErrChirpNotFound {
+			t.Errorf("Expected undoing a missing rechirp to fail but got %v", err)
+		}
+
+		read, _ = db.ReadChirp(original.ID)
+		if read.RechirpCount != 1 {
+			t.Errorf("Expected 1 rechirp but got '%v'", read)
+		}
+
+		// Deleting the original takes its rechirps but leaves quotes
+		db.DeleteChirp(1, original.ID)
+		page, _ := db.ListChirps(ChirpQuery{})
+		if chirpIDs(page.Chirps) != fmt.Sprint([]int{quote.ID}) {
+			t.Errorf("Expected only the quote to remain but got %v", chirpIDs(page.Chirps))
+		}
+	})
+}
+
+func TestLikes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		first, _ := db.CreateChirp(1, "first")
+		second, _ := db.CreateChirp(1, "second")
+		rechirp, _, _ := db.Rechirp(3, second.ID)
+
+		chirp, err := db.LikeChirp(2, first.ID)
+		if err != nil || chirp.LikeCount != 1 {
+			t.Fatalf("Expected 1 like but got '%v' (%v)", chirp, err)
+		}
+		chirp, _ = db.LikeChirp(2, first.ID)
+		if chirp.LikeCount != 1 {
+			t.Errorf("Expected liking twice to keep 1 like but got %v", chirp.LikeCount)
+		}
+
+		// Liking a rechirp likes the original
+		chirp, _ = db.LikeChirp(2, rechirp.ID)
+		if chirp.ID != second.ID || chirp.LikeCount != 1 {
+			t.Errorf("Expected a like on %v but got '%v'", second.ID, chirp)
+		}
+
+		_, err = db.LikeChirp(2, 99)
+		if err != ErrChirpNotFound {
+			t.Errorf("Expected liking a missing chirp to fail but got %v", err)
+		}
+
+		liked, err := db.LikedChirps(2, []int{first.ID, second.ID, rechirp.ID})
+		if err != nil || !liked[first.ID] || !liked[second.ID] || liked[rechirp.ID] {
+			t.Errorf("Expected chirps %v and %v to be liked but got %v (%v)", first.ID, second.ID, liked, err)
+		}
+
+		page, err := db.ListLikes(LikeQuery{UserID: 2, Limit: 1})
+		if err != nil || chirpIDs(page.Chirps) != fmt.Sprint([]int{second.ID}) || page.NextCursor == "" {
+			t.Fatalf("Expected the latest like first but got %v (%v)", chirpIDs(page.Chirps), err)
+		}
+		page, _ = db.ListLikes(LikeQuery{UserID: 2, Limit: 1, Cursor: page.NextCursor})
+		if chirpIDs(page.Chirps) != fmt.Sprint([]int{first.ID}) || page.NextCursor != "" {
+			t.Errorf("Expected the last page to hold %v but got %v", first.ID, chirpIDs(page.Chirps))
+		}
+
+		chirp, _ = db.UnlikeChirp(2, first.ID)
+		if chirp.LikeCount != 0 {
+			t.Errorf("Expected no likes but got %v", chirp.LikeCount)
+		}
+		chirp, err = db.UnlikeChirp(2, first.ID)
+		if err != nil || chirp.LikeCount != 0 {
+			t.Errorf("Expected unliking twice to change nothing but got '%v' (%v)", chirp, err)
+		}
+
+		db.DeleteChirp(1, second.ID)
+		page, _ = db.ListLikes(LikeQuery{UserID: 2})
+		if len(page.Chirps) != 0 {
+			t.Errorf("Expected likes of deleted chirps to go but got %v", chirpIDs(page.Chirps))
+		}
+	})
+}
+
+func TestFollows(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		users := []User{}
+		for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+			user, _ := db.CreateUser(email, "hunter2")
+			users = append(users, user)
+		}
+		a, b, c := users[0].ID, users[1].ID, users[2].ID
+
+		if err := db.Follow(a, a); err != ErrFollowSelf {
+			t.Errorf("Expected following yourself to fail but got %v", err)
+		}
+		if err := db.Follow(a, 99); err != ErrUserNotFound {
+			t.Errorf("Expected following a missing user to fail but got %v", err)
+		}
+
+		db.Follow(a, b)
+		db.Follow(a, b)
+		db.Follow(a, c)
+		db.Follow(c, b)
+
+		page, err := db.ListFollowing(FollowQuery{UserID: a, Limit: 1})
+		if err != nil || len(page.Users) != 1 || page.Users[0].ID != c || page.Users[0].Password != "" {
+			t.Fatalf("Expected %v followed last but got %v (%v)", c, page.Users, err)
+		}
+		page, _ = db.ListFollowing(FollowQuery{UserID: a, Limit: 1, Cursor: page.NextCursor})
+		if len(page.Users) != 1 || page.Users[0].ID != b || page.NextCursor != "" {
+			t.Errorf("Expected %v on the last page but got %v", b, page.Users)
+		}
+
+		page, _ = db.ListFollowers(FollowQuery{UserID: b})
+		if len(page.Users) != 2 || page.Users[0].ID != c || page.Users[1].ID != a {
+			t.Errorf("Expected followers %v and %v but got %v", c, a, page.Users)
+		}
+
+		_, err = db.ListFollowers(FollowQuery{UserID: a, Cursor: page.NextCursor + "x"})
+		if err != ErrInvalidCursor {
+			t.Errorf("Expected a bad cursor to be rejected but got %v", err)
+		}
+
+		db.Unfollow(a, c)
+		db.Unfollow(a, c)
+		page, _ = db.ListFollowing(FollowQuery{UserID: a})
+		if len(page.Users) != 1 || page.Users[0].ID != b {
+			t.Errorf("Expected only %v to be followed but got %v", b, page.Users)
+		}
+	})
+}
+
+func TestTimeline(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		a, _ := db.CreateUser("a@example.com", "hunter2")
+		b, _ := db.CreateUser("b@example.com", "hunter2")
+		c, _ := db.CreateUser("c@example.com", "hunter2")
+
+		for i := 0; i < 3; i++ {
+			db.CreateChirp(b.ID, "from b")
+			db.CreateChirp(c.ID, "from c")
+			db.CreateChirp(a.ID, "from a")
+		}
+		db.DeleteChirp(c.ID, 5)
+
+		db.Follow(a.ID, b.ID)
+		db.Follow(a.ID, c.ID)
+
+		timeline := []Chirp{}
+		query := TimelineQuery{UserID: a.ID, Limit: 2}
+		for {
+			page, err := db.Timeline(query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			timeline = append(timeline, page.Chirps...)
+
+			if page.NextCursor == "" {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+
+		if chirpIDs(timeline) != "[8 7 4 2 1]" {
+			t.Errorf("Expected [8 7 4 2 1] but got %v", chirpIDs(timeline))
+		}
+	})
+}
+
+func TestStoreUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		user, err := db.CreateUser("test@example.com", "hunter2")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if user.Password != "" {
+			t.Errorf("Expected the password hash to be hidden")
+		}
+
+		_, err = db.CreateUser("TEST@example.com", "hunter2")
+		if err == nil {
+			t.Errorf("Expected duplicate email to fail regardless of case")
+		}
+
+		_, err = db.Login("test@example.com", "wrong")
+		if err == nil {
+			t.Errorf("Expected login with the wrong password to fail")
+		}
+
+		err = db.ActivateChirpyRed(user.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		loggedIn, err := db.Login("Test@Example.com", "hunter2")
+		if err != nil || loggedIn.ID != user.ID || !loggedIn.IsChirpyRed {
+			t.Errorf("Expected '%v' to be logged in as chirpy red (%v)", loggedIn, err)
+		}
+	})
+}
+
+func TestProfiles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		alice, _ := db.CreateUser("alice@example.com", "hunter2")
+		bob, _ := db.CreateUser("bob@example.com", "hunter2")
+
+		handle, bio := "Alice_1", "Hello"
+		user, err := db.UpdateProfile(alice.ID, ProfileUpdate{Handle: &handle, Bio: &bio})
+		if err != nil || user.Handle != "Alice_1" || user.Bio != "Hello" || user.Password != "" {
+			t.Fatalf("Expected the profile to be saved but got %+v (%v)", user, err)
+		}
+
+		taken := "alice_1"
+		_, err = db.UpdateProfile(bob.ID, ProfileUpdate{Handle: &taken})
+		if err != ErrHandleTaken {
+			t.Errorf("Expected the handle to be taken but got %v", err)
+		}
+
+		// Changing the password leaves the profile alone
+		db.UpdateUser(alice.ID, "alice@example.com", "hunter3")
+		user, err = db.ReadUserByHandle("@ALICE_1")
+		if err != nil || user.ID != alice.ID || user.Bio != "Hello" || user.Password != "" {
+			t.Errorf("Expected to find %v by handle but got %+v (%v)", alice.ID, user, err)
+		}
+
+		users, _ := db.ReadUsers([]int{alice.ID, bob.ID, 99})
+		if len(users) != 2 || users[alice.ID].Handle != "Alice_1" || users[bob.ID].Password != "" {
+			t.Errorf("Expected both users but got %+v", users)
+		}
+
+		chirp, _ := db.CreateChirp(bob.ID, "hi @alice_1 and @nobody")
+		if len(chirp.Entities) != 1 || chirp.Entities[0].UserID != alice.ID {
+			t.Errorf("Expected a mention of %v by handle but got %+v", alice.ID, chirp.Entities)
+		}
+
+		// Giving up a handle frees it
+		empty := ""
+		db.UpdateProfile(alice.ID, ProfileUpdate{Handle: &empty})
+		if _, err := db.ReadUserByHandle("alice_1"); err != ErrUserNotFound {
+			t.Errorf("Expected the handle to be released but got %v", err)
+		}
+		if _, err := db.UpdateProfile(bob.ID, ProfileUpdate{Handle: &taken}); err != nil {
+			t.Errorf("Expected the released handle to be claimed but got %v", err)
+		}
+	})
+}
+
+func TestDeleteUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		later := time.Now().Add(time.Hour)
+		alice, _ := db.CreateUser("alice@example.com", "hunter2")
+		bob, _ := db.CreateUser("bob@example.com", "hunter2")
+
+		mine, _ := db.CreateChirp(alice.ID, "#gone soon")
+		theirs, _ := db.CreateChirp(bob.ID, "staying")
+		db.Rechirp(alice.ID, theirs.ID)
+		db.CreateQuote(alice.ID, theirs.ID, "quote")
+		db.CreateQuote(alice.ID, theirs.ID, "another quote")
+		db.LikeChirp(alice.ID, theirs.ID)
+		db.LikeChirp(bob.ID, mine.ID)
+		db.Follow(alice.ID, bob.ID)
+		db.Follow(bob.ID, alice.ID)
+		db.SaveRefreshToken(alice.ID, "alice", Device{}, later)
+		db.SaveRefreshToken(bob.ID, "bob", Device{}, later)
+
+		deleted, err := db.DeleteUser(alice.ID)
+		if err != nil || deleted.DeletedAt == nil {
+			t.Fatalf("Expected the user to be deleted but got %+v (%v)", deleted, err)
+		}
+		if db.CheckRefreshToken("alice") || !db.CheckRefreshToken("bob") {
+			t.Errorf("Expected only the deleted user's tokens to be revoked")
+		}
+
+		page, _ := db.ListChirps(ChirpQuery{})
+		if chirpIDs(page.Chirps) != fmt.Sprint([]int{theirs.ID}) {
+			t.Errorf("Expected only %v to be visible but got %v", theirs.ID, chirpIDs(page.Chirps))
+		}
+		if chirp, _ := db.ReadChirp(mine.ID); chirp.ID != 0 {
+			t.Errorf("Expected %v to be hidden but got %+v", mine.ID, chirp)
+		}
+		likes, _ := db.ListLikes(LikeQuery{UserID: bob.ID})
+		followers, _ := db.ListFollowers(FollowQuery{UserID: bob.ID})
+		trends, _ := db.Trending(TrendingQuery{})
+		if len(likes.Chirps) != 0 || len(followers.Users) != 0 || len(trends) != 0 {
+			t.Errorf("Expected no likes, followers or trends but got %v, %v and %v", likes.Chirps, followers.Users, trends)
+		}
+
+		if purged, _ := db.PurgeDeletedUsers(deleted.DeletedAt.Add(-time.Second)); purged != 0 {
+			t.Errorf("Expected nothing to be purged in the grace period but purged %v", purged)
+		}
+
+		if _, err := db.RestoreUser("alice@example.com", "wrong"); err == nil {
+			t.Errorf("Expected a wrong password not to restore the user")
+		}
+		restored, err := db.RestoreUser("alice@example.com", "hunter2")
+		if err != nil || restored.DeletedAt != nil || restored.Password != "" {
+			t.Errorf("Expected the user to be restored but got %+v (%v)", restored, err)
+		}
+		trends, _ = db.Trending(TrendingQuery{})
+		if chirp, _ := db.ReadChirp(mine.ID); chirp.ID != mine.ID || len(trends) != 1 || db.CheckRefreshToken("alice") {
+			t.Errorf("Expected chirps and trends back but tokens still revoked")
+		}
+
+		deleted, _ = db.DeleteUser(alice.ID)
+		purged, err := db.PurgeDeletedUsers(deleted.DeletedAt.Add(time.Second))
+		if err != nil || purged != 1 {
+			t.Fatalf("Expected 1 user to be purged but got %v (%v)", purged, err)
+		}
+
+		if _, err := db.ReadUser(alice.ID); err != ErrUserNotFound {
+			t.Errorf("Expected the user to be gone but got %v", err)
+		}
+		chirp, _ := db.ReadChirp(theirs.ID)
+		if chirp.RechirpCount != 0 || chirp.QuoteCount != 0 || chirp.LikeCount != 0 {
+			t.Errorf("Expected the purged user's rechirps, quotes and likes to be uncounted but got %+v", chirp)
+		}
+		page, _ = db.ListChirps(ChirpQuery{})
+		likes, _ = db.ListLikes(LikeQuery{UserID: bob.ID})
+		following, _ := db.ListFollowing(FollowQuery{UserID: bob.ID})
+		if len(page.Chirps) != 1 || len(likes.Chirps) != 0 || len(following.Users) != 0 {
+			t.Errorf("Expected only %v left but got %v, %v and %v", theirs.ID, page.Chirps, likes.Chirps, following.Users)
+		}
+	})
+}
+
+func TestDeletedTargets(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		alice, _ := db.CreateUser("alice@example.com", "hunter2")
+		bob, _ := db.CreateUser("bob@example.com", "hunter2")
+
+		mine, _ := db.CreateChirp(alice.ID, "hidden soon")
+		rechirp, _, _ := db.Rechirp(bob.ID, mine.ID)
+		db.DeleteUser(alice.ID)
+
+		// bob's rechirp is still visible but leads to alice's chirp
+		for _, chirpID := range []int{mine.ID, rechirp.ID} {
+			if _, err := db.LikeChirp(bob.ID, chirpID); err != ErrChirpNotFound {
+				t.Errorf("Expected liking %v to fail but got %v", chirpID, err)
+			}
+			if _, _, err := db.Rechirp(bob.ID, chirpID); err != ErrChirpNotFound {
+				t.Errorf("Expected rechirping %v to fail but got %v", chirpID, err)
+			}
+			if _, err := db.CreateQuote(bob.ID, chirpID, "quote"); err != ErrChirpNotFound {
+				t.Errorf("Expected quoting %v to fail but got %v", chirpID, err)
+			}
+		}
+		if _, err := db.CreateReply(bob.ID, mine.ID, "reply"); err != ErrChirpNotFound {
+			t.Errorf("Expected replying to a hidden chirp to fail but got %v", err)
+		}
+		if err := db.Follow(bob.ID, alice.ID); err != ErrUserNotFound {
+			t.Errorf("Expected following a deleted user to fail but got %v", err)
+		}
+
+		if _, err := db.ListRevisions(mine.ID); err != ErrChirpNotFound {
+			t.Errorf("Expected the revisions of a hidden chirp to be hidden but got %v", err)
+		}
+
+		db.RestoreUser("alice@example.com", "hunter2")
+		read, _ := db.ReadChirp(mine.ID)
+		followers, _ := db.ListFollowers(FollowQuery{UserID: alice.ID})
+		if read.LikeCount != 0 || read.QuoteCount != 0 || read.RechirpCount != 1 || len(followers.Users) != 0 {
+			t.Errorf("Expected nothing added while deleted but got %+v and %v", read, followers.Users)
+		}
+	})
+}
+
+func TestStoreRefreshTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		later := time.Now().Add(time.Hour)
+
+		if db.CheckRefreshToken("token") {
+			t.Errorf("Expected unknown token to be invalid")
+		}
+
+		db.SaveRefreshToken(1, "token", Device{}, later)
+		if !db.CheckRefreshToken("token") {
+			t.Errorf("Expected saved token to be valid")
+		}
+
+		db.RevokeRefreshToken("token")
+		if db.CheckRefreshToken("token") {
+			t.Errorf("Expected revoked token to be invalid")
+		}
+	})
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		later := time.Now().Add(time.Hour)
+
+		if _, err := db.RotateRefreshToken("unknown", "next", Device{}, later); err != ErrInvalidRefreshToken {
+			t.Errorf("Expected an unknown token to be invalid but got %v", err)
+		}
+
+		db.SaveRefreshToken(1, "first", Device{}, later)
+		db.SaveRefreshToken(1, "other device", Device{}, later)
+
+		second, err := db.RotateRefreshToken("first", "second", Device{}, later)
+		if err != nil || second.UserID != 1 || second.Family == "" {
+			t.Fatalf("Expected the token to be rotated but got %+v (%v)", second, err)
+		}
+		if db.CheckRefreshToken("first") || !db.CheckRefreshToken("second") {
+			t.Errorf("Expected only the new token to be valid")
+		}
+
+		third, err := db.RotateRefreshToken("second", "third", Device{}, later)
+		if err != nil || third.Family != second.Family {
+			t.Fatalf("Expected the rotated token to stay in family %v but got %+v (%v)", second.Family, third, err)
+		}
+
+		reused, err := db.RotateRefreshToken("first", "stolen", Device{}, later)
+		if err != ErrRefreshTokenReused || reused.Family != second.Family {
+			t.Errorf("Expected reuse to be detected but got %+v (%v)", reused, err)
+		}
+		if db.CheckRefreshToken("third") || db.CheckRefreshToken("stolen") {
+			t.Errorf("Expected the whole family to be revoked")
+		}
+		if !db.CheckRefreshToken("other device") {
+			t.Errorf("Expected other families to stay valid")
+		}
+
+		if _, err := db.RotateRefreshToken("third", "next", Device{}, later); err != ErrInvalidRefreshToken {
+			t.Errorf("Expected a revoked token to be invalid but got %v", err)
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		later := time.Now().Add(time.Hour)
+
+		laptop, err := db.SaveRefreshToken(1, "laptop", Device{Name: "Laptop", UserAgent: "Firefox", IP: "10.0.0.1"}, later)
+		if err != nil || laptop.ID == "" || laptop.DeviceName != "Laptop" || laptop.IP != "10.0.0.1" {
+			t.Fatalf("Expected a session to be started but got %+v (%v)", laptop, err)
+		}
+		phone, _ := db.SaveRefreshToken(1, "phone", Device{UserAgent: "Safari"}, later)
+		db.SaveRefreshToken(2, "theirs", Device{}, later)
+
+		// Using the laptop again moves it to the top
+		time.Sleep(time.Millisecond)
+		db.RotateRefreshToken("laptop", "laptop 2", Device{UserAgent: "Firefox", IP: "10.0.0.2"}, later)
+
+		sessions, err := db.ListSessions(1)
+		if err != nil || len(sessions) != 2 || sessions[0].ID != laptop.ID || sessions[1].ID != phone.ID {
+			t.Fatalf("Expected the laptop then the phone but got %+v (%v)", sessions, err)
+		}
+		if sessions[0].DeviceName != "Laptop" || sessions[0].IP != "10.0.0.2" || !sessions[0].LastUsedAt.After(laptop.LastUsedAt) {
+			t.Errorf("Expected the laptop's last use to be recorded but got %+v", sessions[0])
+		}
+
+		if err := db.RevokeSession(2, laptop.ID); err != ErrSessionNotFound {
+			t.Errorf("Expected another user's session not to be found but got %v", err)
+		}
+		if err := db.RevokeSession(1, laptop.ID); err != nil || db.CheckRefreshToken("laptop 2") {
+			t.Errorf("Expected the laptop to be logged out (%v)", err)
+		}
+
+		db.RevokeRefreshToken("phone")
+		if sessions, _ := db.ListSessions(1); len(sessions) != 0 {
+			t.Errorf("Expected revoking the token to end its session but got %+v", sessions)
+		}
+
+		db.SaveRefreshToken(2, "another", Device{}, later)
+		if err := db.RevokeSessions(2); err != nil || db.CheckRefreshToken("theirs") || db.CheckRefreshToken("another") {
+			t.Errorf("Expected every session to be logged out (%v)", err)
+		}
+		if sessions, _ := db.ListSessions(2); len(sessions) != 0 {
+			t.Errorf("Expected no sessions left but got %+v", sessions)
+		}
+	})
+}
+
+func TestPurgeExpiredTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		now := time.Now()
+
+		db.SaveRefreshToken(1, "expired", Device{}, now.Add(-time.Minute))
+		db.SaveRefreshToken(1, "revoked", Device{}, now.Add(time.Hour))
+		db.RevokeRefreshToken("revoked")
+		db.SaveRefreshToken(1, "rotated", Device{}, now.Add(time.Hour))
+		db.RotateRefreshToken("rotated", "live", Device{}, now.Add(time.Hour))
+
+		if db.CheckRefreshToken("expired") {
+			t.Errorf("Expected an expired token to be invalid")
+		}
+		if live, err := db.CountLiveSessions(); err != nil || live != 1 {
+			t.Errorf("Expected 1 live session but got %v (%v)", live, err)
+		}
+
+		purged, err := db.PurgeExpiredTokens(now)
+		if err != nil || purged != 2 {
+			t.Fatalf("Expected 2 tokens to be purged but got %v (%v)", purged, err)
+		}
+
+		// The rotated token is kept so reusing it is still caught
+		if _, err := db.RotateRefreshToken("rotated", "stolen", Device{}, now.Add(time.Hour)); err != ErrRefreshTokenReused {
+			t.Errorf("Expected reuse to be detected but got %v", err)
+		}
+
+		purged, _ = db.PurgeExpiredTokens(now)
+		if live, _ := db.CountLiveSessions(); purged != 2 || live != 0 {
+			t.Errorf("Expected the revoked family to be purged but purged %v with %v live sessions", purged, live)
+		}
+	})
+}
+
+func TestListChirpsSortByCreatedAt(t *testing.T) {
+	db := NewMemoryDB()
+
+	now := time.Now().UTC()
+	db.schema.putChirp(Chirp{ID: 1, AuthorID: 1, CreatedAt: now})
+	db.schema.putChirp(Chirp{ID: 2, AuthorID: 1, CreatedAt: now.Add(-time.Hour)})
+	db.schema.putChirp(Chirp{ID: 3, AuthorID: 1, CreatedAt: now})
+
+	page, _ := db.ListChirps(ChirpQuery{SortBy: SortByCreatedAt, SortDesc: true})
+	chirps := page.Chirps
+
+	ids := []int{}
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.ID)
+	}
+	if fmt.Sprint(ids) != "[3 1 2]" {
+		t.Errorf("Expected [3 1 2] but got %v", ids)
+	}
+}
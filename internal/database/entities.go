@@ -0,0 +1,131 @@
+package database
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Kinds of Entity.
+const (
+	EntityHashtag = "hashtag"
+	EntityMention = "mention"
+)
+
+// Entity is a #hashtag or @mention found in a chirp body. Start and End
+// are byte offsets into the body and RuneStart and RuneEnd the same span in
+// runes, both include the leading # or @ and exclude the end.
+type Entity struct {
+	Type      string `json:"type"`
+	Text      string `json:"text"`
+	Start     int    `json:"start"`
+	End       int    `json:"end"`
+	RuneStart int    `json:"rune_start"`
+	RuneEnd   int    `json:"rune_end"`
+	// UserID is the user a mention refers to
+	UserID int `json:"user_id,omitempty"`
+}
+
+// HashtagKey normalises a hashtag for lookups, tags are case-insensitive.
+func HashtagKey(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
+}
+
+func isEntityRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// parseEntities finds the hashtags and mentions in body. Text is the tag or
+// name after the # or @, hashtags are normalised with HashtagKey. Mentions
+// are only candidates until resolveMentions finds who they refer to.
+func parseEntities(body string) []Entity {
+	entities := []Entity{}
+
+	runeIndex := 0
+	prev := ' '
+	for i := 0; i < len(body); {
+		r, size := utf8.DecodeRuneInString(body[i:])
+
+		// An entity starts at # or @ that doesn't follow a word, so
+		// emails and the like are left alone
+		if (r == '#' || r == '@') && !isEntityRune(prev) {
+			end := i + size
+			runes := 1
+			for end < len(body) {
+				next, nextSize := utf8.DecodeRuneInString(body[end:])
+				if !isEntityRune(next) {
+					break
+				}
+				end += nextSize
+				runes++
+			}
+
+			if runes > 1 {
+				entity := Entity{
+					Type:      EntityMention,
+					Text:      body[i+size : end],
+					Start:     i,
+					End:       end,
+					RuneStart: runeIndex,
+					RuneEnd:   runeIndex + runes,
+				}
+				if r == '#' {
+					entity.Type = EntityHashtag
+					entity.Text = HashtagKey(entity.Text)
+				}
+				entities = append(entities, entity)
+
+				prev, _ = utf8.DecodeLastRuneInString(body[:end])
+				i = end
+				runeIndex += runes
+				continue
+			}
+		}
+
+		prev = r
+		i += size
+		runeIndex++
+	}
+
+	return entities
+}
+
+// resolveMentions fills in the user each mention refers to using lookup,
+// which returns 0 for no one. Mentions of no one are dropped.
+func resolveMentions(entities []Entity, lookup func(name string) int) []Entity {
+	resolved := []Entity{}
+	for _, entity := range entities {
+		if entity.Type == EntityMention {
+			entity.UserID = lookup(entity.Text)
+			if entity.UserID == 0 {
+				continue
+			}
+		}
+		resolved = append(resolved, entity)
+	}
+
+	return resolved
+}
+
+// hashtags returns the distinct tags in entities.
+func hashtags(entities []Entity) []string {
+	tags := []string{}
+	for _, entity := range entities {
+		if entity.Type == EntityHashtag && !slices.Contains(tags, entity.Text) {
+			tags = append(tags, entity.Text)
+		}
+	}
+	return tags
+}
+
+// mentions returns the distinct users mentioned in entities.
+func mentions(entities []Entity) []int {
+	userIDs := []int{}
+	for _, entity := range entities {
+		if entity.Type == EntityMention && !slices.Contains(userIDs, entity.UserID) {
+			userIDs = append(userIDs, entity.UserID)
+		}
+	}
+	return userIDs
+}
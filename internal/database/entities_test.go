@@ -0,0 +1,86 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEntities(t *testing.T) {
+	cases := []struct {
+		body     string
+		expected []Entity
+	}{
+		{"no entities here", []Entity{}},
+		{"mail me@example.com or # alone", []Entity{}},
+		{"#Go and @1", []Entity{
+			{Type: EntityHashtag, Text: "go", Start: 0, End: 3, RuneStart: 0, RuneEnd: 3},
+			{Type: EntityMention, Text: "1", Start: 8, End: 10, RuneStart: 8, RuneEnd: 10},
+		}},
+		{"héllo #café, @2!", []Entity{
+			{Type: EntityHashtag, Text: "café", Start: 7, End: 13, RuneStart: 6, RuneEnd: 11},
+			{Type: EntityMention, Text: "2", Start: 15, End: 17, RuneStart: 13, RuneEnd: 15},
+		}},
+		{"#one#two", []Entity{
+			{Type: EntityHashtag, Text: "one", Start: 0, End: 4, RuneStart: 0, RuneEnd: 4},
+		}},
+	}
+
+	for _, c := range cases {
+		entities := parseEntities(c.body)
+		if !reflect.DeepEqual(entities, c.expected) {
+			t.Errorf("Expected %q to have entities %+v but got %+v", c.body, c.expected, entities)
+		}
+	}
+}
+
+func TestChirpEntities(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		user, _ := db.CreateUser("a@example.com", "hunter2")
+
+		chirp, err := db.CreateChirp(2, "hi @1 and @99 #Golang")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(chirp.Entities) != 2 || chirp.Entities[0].UserID != user.ID || chirp.Entities[1].Text != "golang" {
+			t.Errorf("Expected a mention of %v and #golang but got %+v", user.ID, chirp.Entities)
+		}
+
+		db.CreateChirp(1, "more #golang")        // 2
+		db.CreateChirp(1, "#go is not #golang?") // 3
+		db.CreateReply(2, 1, "@1 #GOLANG")       // 4
+
+		cases := []struct {
+			query    ChirpQuery
+			expected string
+		}{
+			{ChirpQuery{Hashtag: "golang", SortDesc: true}, "[4 3 2 1]"},
+			{ChirpQuery{Hashtag: "#GoLang", AuthorID: 1}, "[2 3]"},
+			{ChirpQuery{Hashtag: "go"}, "[3]"},
+			{ChirpQuery{Mentions: user.ID}, "[1 4]"},
+			{ChirpQuery{Mentions: 99}, "[]"},
+		}
+
+		for _, c := range cases {
+			page, err := db.ListChirps(c.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if chirpIDs(page.Chirps) != c.expected {
+				t.Errorf("Expected %+v to list %v but got %v", c.query, c.expected, chirpIDs(page.Chirps))
+			}
+		}
+
+		// Edits and deletes keep the lookups up to date
+		db.UpdateChirp(2, 1, "no longer")
+		db.DeleteChirp(2, 4)
+
+		page, _ := db.ListChirps(ChirpQuery{Hashtag: "golang"})
+		if chirpIDs(page.Chirps) != "[2 3]" {
+			t.Errorf("Expected only [2 3] to be tagged but got %v", chirpIDs(page.Chirps))
+		}
+		page, _ = db.ListChirps(ChirpQuery{Mentions: user.ID})
+		if chirpIDs(page.Chirps) != "[]" {
+			t.Errorf("Expected no mentions left but got %v", chirpIDs(page.Chirps))
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// ID strategies for new chirps and users, picked with Config.IDs.
+const (
+	// SequenceIDs counts up from 1 per table.
+	SequenceIDs = "sequence"
+	// SnowflakeIDs are time-sortable: milliseconds since snowflakeEpoch in
+	// the high bits and a counter in the low snowflakeCounterBits. They stay
+	// below 2^53 so JavaScript clients can use them as plain numbers.
+	SnowflakeIDs = "snowflake"
+)
+
+const (
+	snowflakeEpoch       = 1672531200000 // 2023-01-01T00:00:00Z in milliseconds
+	snowflakeCounterBits = 10
+)
+
+func validIDStrategy(ids string) error {
+	switch ids {
+	case "", SequenceIDs, SnowflakeIDs:
+		return nil
+	}
+
+	return errors.New("unknown id strategy " + ids)
+}
+
+// nextID returns the ID to use after last, the highest ID ever issued for a
+// table. It never goes backwards, even if a snowflake clock does.
+func nextID(ids string, last int) int {
+	if ids != SnowflakeIDs {
+		return last + 1
+	}
+
+	id := int(time.Now().UnixMilli()-snowflakeEpoch) << snowflakeCounterBits
+	if id <= last {
+		id = last + 1
+	}
+
+	return id
+}
+
+// SnowflakeTime returns when a snowflake ID was issued.
+func SnowflakeTime(id int) time.Time {
+	return time.UnixMilli(int64(id>>snowflakeCounterBits) + snowflakeEpoch).UTC()
+}
+
+// nextID reserves the next ID for table in schema.Sequences and returns it
+// with the change that persists the sequence.
+func (db *DB) nextID(schema *Schema, table string) (int, change) {
+	id := nextID(db.ids, schema.Sequences[table])
+	schema.Sequences[table] = id
+
+	return id, putChange("sequences", table, id)
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIDsSurviveDeletes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		db.CreateChirp(1, "first")
+		second, _ := db.CreateChirp(1, "second")
+		db.DeleteChirp(1, second.ID)
+
+		third, err := db.CreateChirp(1, "third")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if third.ID <= second.ID {
+			t.Errorf("Expected an ID after %v but got %v", second.ID, third.ID)
+		}
+
+		page, _ := db.ListChirps(ChirpQuery{})
+		chirps := page.Chirps
+		if len(chirps) != 2 {
+			t.Errorf("Expected 2 chirps but got '%v'", chirps)
+		}
+	})
+}
+
+func TestSnowflakeIDs(t *testing.T) {
+	memory := NewMemoryDB()
+	memory.ids = SnowflakeIDs
+	sqlite := newTestSQLiteDB(t)
+	sqlite.ids = SnowflakeIDs
+
+	for _, db := range []Store{memory, sqlite} {
+		start := time.Now().Add(-time.Millisecond)
+
+		last := 0
+		for i := 0; i < 5; i++ {
+			chirp, err := db.CreateChirp(1, "chirp")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if chirp.ID <= last {
+				t.Errorf("Expected an ID after %v but got %v", last, chirp.ID)
+			}
+			last = chirp.ID
+		}
+
+		issued := SnowflakeTime(last)
+		if issued.Before(start.Truncate(time.Millisecond)) || issued.After(time.Now().Add(time.Second)) {
+			t.Errorf("Expected %v to be issued around now", issued)
+		}
+
+		page, _ := db.ListChirps(ChirpQuery{BeforeID: last})
+		chirps := page.Chirps
+		if len(chirps) != 4 {
+			t.Errorf("Expected 4 chirps before %v but got %v", last, len(chirps))
+		}
+	}
+}
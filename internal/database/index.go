@@ -0,0 +1,585 @@
+package database
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// buildIndexes derives the secondary indexes from the tables. They are not
+// persisted, so this runs whenever a Schema is loaded.
+func (s *Schema) buildIndexes() {
+	s.usersByEmail = map[string]int{}
+	s.usersByHandle = map[string]int{}
+	for _, user := range s.Users {
+		s.usersByEmail[emailKey(user.Email)] = user.ID
+		if user.Handle != "" {
+			s.usersByHandle[handleKey(user.Handle)] = user.ID
+		}
+	}
+
+	s.refreshTokensByUser = map[int]map[string]struct{}{}
+	for token, refreshToken := range s.RefreshTokens {
+		s.indexRefreshToken(token, refreshToken)
+	}
+
+	s.sessionsByUser = map[int]map[string]struct{}{}
+	for _, session := range s.Sessions {
+		s.indexSession(session)
+	}
+
+	s.chirpsByAuthor = map[int][]int{}
+	s.chirpsByHashtag = map[string][]int{}
+	s.mentionsByUser = map[int][]int{}
+	windows := DefaultTrendingWindows
+	if s.trends != nil {
+		windows = s.trends.windows
+	}
+	s.trends = newTrendTracker(windows)
+	s.search = newSearchIndex()
+	s.repliesByChirp = map[int]map[int]struct{}{}
+	s.rechirps = map[int]map[int]int{}
+
+	// In ID order so the sorted indexes are only ever appended to
+	ids := []int{}
+	for id := range s.Chirps {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		s.indexChirp(s.Chirps[id])
+	}
+
+	s.likesByUser = map[int]map[int]int{}
+	s.likesByChirp = map[int]map[int]int{}
+	for _, like := range s.Likes {
+		s.indexLike(like)
+	}
+
+	s.following = map[int]map[int]int{}
+	s.followers = map[int]map[int]int{}
+	for _, follow := range s.Follows {
+		s.indexFollow(follow)
+	}
+
+	s.revisionsByChirp = map[int][]int{}
+	for _, revision := range s.Revisions {
+		s.revisionsByChirp[revision.ChirpID] = append(s.revisionsByChirp[revision.ChirpID], revision.ID)
+	}
+	for _, ids := range s.revisionsByChirp {
+		sort.Ints(ids)
+	}
+}
+
+// emailKey makes email lookups case-insensitive.
+func emailKey(email string) string {
+	return strings.ToLower(email)
+}
+
+func (s *Schema) putUser(user User) {
+	old, ok := s.Users[user.ID]
+	if ok {
+		delete(s.usersByEmail, emailKey(old.Email))
+		delete(s.usersByHandle, handleKey(old.Handle))
+	}
+
+	s.Users[user.ID] = user
+	s.usersByEmail[emailKey(user.Email)] = user.ID
+	if user.Handle != "" {
+		s.usersByHandle[handleKey(user.Handle)] = user.ID
+	}
+}
+
+func (s *Schema) findUserByEmail(email string) (User, error) {
+	id, ok := s.usersByEmail[emailKey(email)]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	return s.Users[id], nil
+}
+
+func (s *Schema) removeUser(userID int) {
+	user, ok := s.Users[userID]
+	if !ok {
+		return
+	}
+
+	delete(s.Users, userID)
+	delete(s.usersByEmail, emailKey(user.Email))
+	delete(s.usersByHandle, handleKey(user.Handle))
+}
+
+// deleted reports whether userID's account is waiting to be purged.
+func (s *Schema) deleted(userID int) bool {
+	user, ok := s.Users[userID]
+	return ok && user.DeletedAt != nil
+}
+
+// hidden reports whether chirp belongs to a deleted account.
+func (s *Schema) hidden(chirp Chirp) bool {
+	return s.deleted(chirp.AuthorID)
+}
+
+func (s *Schema) putRefreshToken(token string, refreshToken RefreshToken) {
+	s.RefreshTokens[token] = refreshToken
+	s.indexRefreshToken(token, refreshToken)
+}
+
+func (s *Schema) indexRefreshToken(token string, refreshToken RefreshToken) {
+	tokens, ok := s.refreshTokensByUser[refreshToken.UserID]
+	if !ok {
+		tokens = map[string]struct{}{}
+		s.refreshTokensByUser[refreshToken.UserID] = tokens
+	}
+	tokens[token] = struct{}{}
+}
+
+func (s *Schema) removeRefreshToken(token string) {
+	refreshToken, ok := s.RefreshTokens[token]
+	if !ok {
+		return
+	}
+
+	delete(s.RefreshTokens, token)
+	delete(s.refreshTokensByUser[refreshToken.UserID], token)
+	if len(s.refreshTokensByUser[refreshToken.UserID]) == 0 {
+		delete(s.refreshTokensByUser, refreshToken.UserID)
+	}
+}
+
+func (s *Schema) putSession(session Session) {
+	s.Sessions[session.ID] = session
+	s.indexSession(session)
+}
+
+func (s *Schema) indexSession(session Session) {
+	sessions, ok := s.sessionsByUser[session.UserID]
+	if !ok {
+		sessions = map[string]struct{}{}
+		s.sessionsByUser[session.UserID] = sessions
+	}
+	sessions[session.ID] = struct{}{}
+}
+
+func (s *Schema) removeSession(id string) {
+	session, ok := s.Sessions[id]
+	if !ok {
+		return
+	}
+
+	delete(s.Sessions, id)
+	delete(s.sessionsByUser[session.UserID], id)
+	if len(s.sessionsByUser[session.UserID]) == 0 {
+		delete(s.sessionsByUser, session.UserID)
+	}
+}
+
+// deleteChirp removes chirp with its history, likes and rechirps and
+// returns the changes to persist. Quotes stay as they have a body of their
+// own.
+func (s *Schema) deleteChirp(chirp Chirp) []change {
+	changes := []change{deleteChange("chirps", chirp.ID)}
+	for _, revision := range s.revisionsFor(chirp.ID) {
+		changes = append(changes, deleteChange("revisions", revision.ID))
+	}
+	for _, id := range s.likesByChirp[chirp.ID] {
+		changes = append(changes, deleteChange("likes", id))
+	}
+	for _, rechirp := range s.rechirpsOf(chirp.ID) {
+		changes = append(changes, deleteChange("chirps", rechirp.ID))
+		s.removeChirp(rechirp.ID)
+	}
+	changes = append(changes, s.uncount(chirp)...)
+
+	s.removeChirp(chirp.ID)
+
+	return changes
+}
+
+// purgeUser removes user and everything that belongs to them, returning
+// the changes to persist.
+func (s *Schema) purgeUser(user User) []change {
+	changes := []change{}
+
+	for _, chirp := range s.chirpsFor(user.ID) {
+		// A rechirp of one of their own chirps may already be gone
+		chirp, ok := s.Chirps[chirp.ID]
+		if ok {
+			changes = append(changes, s.deleteChirp(chirp)...)
+		}
+	}
+
+	// Likes of their own chirps went with the chirps
+	for chirpID, id := range s.likesByUser[user.ID] {
+		chirp := s.Chirps[chirpID]
+		chirp.LikeCount--
+		s.putChirp(chirp)
+		s.removeLike(id)
+		changes = append(changes, deleteChange("likes", id), putChange("chirps", chirp.ID, chirp))
+	}
+
+	for _, id := range s.following[user.ID] {
+		s.removeFollow(id)
+		changes = append(changes, deleteChange("follows", id))
+	}
+	for _, id := range s.followers[user.ID] {
+		s.removeFollow(id)
+		changes = append(changes, deleteChange("follows", id))
+	}
+
+	for token := range s.refreshTokensByUser[user.ID] {
+		delete(s.RefreshTokens, token)
+		changes = append(changes, deleteChange("refresh_tokens", token))
+	}
+	delete(s.refreshTokensByUser, user.ID)
+
+	for id := range s.sessionsByUser[user.ID] {
+		s.removeSession(id)
+		changes = append(changes, deleteChange("sessions", id))
+	}
+
+	s.removeUser(user.ID)
+	return append(changes, deleteChange("users", user.ID))
+}
+
+func (s *Schema) findUserByHandle(handle string) (User, error) {
+	id, ok := s.usersByHandle[handleKey(handle)]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	return s.Users[id], nil
+}
+
+func (s *Schema) findUserById(id int) (User, error) {
+	user, ok := s.Users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	return user, nil
+}
+
+func (s *Schema) putChirp(chirp Chirp) {
+	// Only the body and what's derived from it can change
+	old, ok := s.Chirps[chirp.ID]
+	if ok {
+		s.search.remove(old.ID, old.Body)
+		s.unindexEntities(old)
+	}
+
+	s.Chirps[chirp.ID] = chirp
+	s.indexChirp(chirp)
+}
+
+func (s *Schema) indexChirp(chirp Chirp) {
+	s.chirpsByAuthor[chirp.AuthorID] = insertSorted(s.chirpsByAuthor[chirp.AuthorID], chirp.ID)
+
+	for _, tag := range hashtags(chirp.Entities) {
+		s.chirpsByHashtag[tag] = insertSorted(s.chirpsByHashtag[tag], chirp.ID)
+	}
+	for _, userID := range mentions(chirp.Entities) {
+		s.mentionsByUser[userID] = insertSorted(s.mentionsByUser[userID], chirp.ID)
+	}
+	if !s.hidden(chirp) {
+		s.trends.addChirp(chirp)
+	}
+
+	if chirp.InReplyTo != 0 {
+		replies, ok := s.repliesByChirp[chirp.InReplyTo]
+		if !ok {
+			replies = map[int]struct{}{}
+			s.repliesByChirp[chirp.InReplyTo] = replies
+		}
+		replies[chirp.ID] = struct{}{}
+	}
+
+	if chirp.RechirpOf != 0 {
+		byUser, ok := s.rechirps[chirp.RechirpOf]
+		if !ok {
+			byUser = map[int]int{}
+			s.rechirps[chirp.RechirpOf] = byUser
+		}
+		byUser[chirp.AuthorID] = chirp.ID
+	}
+
+	s.search.add(chirp.ID, chirp.Body)
+}
+
+func (s *Schema) removeChirp(chirpID int) {
+	chirp, ok := s.Chirps[chirpID]
+	if !ok {
+		return
+	}
+
+	delete(s.Chirps, chirpID)
+
+	s.chirpsByAuthor[chirp.AuthorID] = removeSorted(s.chirpsByAuthor[chirp.AuthorID], chirpID)
+	if len(s.chirpsByAuthor[chirp.AuthorID]) == 0 {
+		delete(s.chirpsByAuthor, chirp.AuthorID)
+	}
+	s.unindexEntities(chirp)
+
+	// Replies outlive the chirp they answer, only its own entry goes
+	delete(s.repliesByChirp[chirp.InReplyTo], chirpID)
+	if len(s.repliesByChirp[chirp.InReplyTo]) == 0 {
+		delete(s.repliesByChirp, chirp.InReplyTo)
+	}
+
+	if chirp.RechirpOf != 0 {
+		delete(s.rechirps[chirp.RechirpOf], chirp.AuthorID)
+		if len(s.rechirps[chirp.RechirpOf]) == 0 {
+			delete(s.rechirps, chirp.RechirpOf)
+		}
+	}
+
+	s.search.remove(chirp.ID, chirp.Body)
+
+	for _, id := range s.revisionsByChirp[chirpID] {
+		delete(s.Revisions, id)
+	}
+	delete(s.revisionsByChirp, chirpID)
+
+	for _, id := range s.likesByChirp[chirpID] {
+		s.removeLike(id)
+	}
+}
+
+// repliesTo returns the direct replies to chirpID.
+func (s *Schema) repliesTo(chirpID int) []Chirp {
+	chirps := []Chirp{}
+	for id := range s.repliesByChirp[chirpID] {
+		chirps = append(chirps, s.Chirps[id])
+	}
+	return chirps
+}
+
+func (s *Schema) unindexEntities(chirp Chirp) {
+	if !s.hidden(chirp) {
+		s.trends.removeChirp(chirp)
+	}
+	for _, tag := range hashtags(chirp.Entities) {
+		s.chirpsByHashtag[tag] = removeSorted(s.chirpsByHashtag[tag], chirp.ID)
+		if len(s.chirpsByHashtag[tag]) == 0 {
+			delete(s.chirpsByHashtag, tag)
+		}
+	}
+	for _, userID := range mentions(chirp.Entities) {
+		s.mentionsByUser[userID] = removeSorted(s.mentionsByUser[userID], chirp.ID)
+		if len(s.mentionsByUser[userID]) == 0 {
+			delete(s.mentionsByUser, userID)
+		}
+	}
+}
+
+// entities parses body and resolves its mentions against the users table.
+func (s *Schema) entities(body string) []Entity {
+	return resolveMentions(parseEntities(body), s.mentionedUser)
+}
+
+// mentionedUser returns the user @name refers to, by handle or by ID.
+func (s *Schema) mentionedUser(name string) int {
+	id, err := strconv.Atoi(name)
+	if err != nil {
+		user, err := s.findUserByHandle(name)
+		if err != nil {
+			return 0
+		}
+		return user.ID
+	}
+
+	_, ok := s.Users[id]
+	if !ok {
+		return 0
+	}
+	return id
+}
+
+// insertSorted adds id to the ascending ids unless it's already there.
+func insertSorted(ids []int, id int) []int {
+	i, found := slices.BinarySearch(ids, id)
+	if found {
+		return ids
+	}
+	return slices.Insert(ids, i, id)
+}
+
+func removeSorted(ids []int, id int) []int {
+	i, found := slices.BinarySearch(ids, id)
+	if !found {
+		return ids
+	}
+	return slices.Delete(ids, i, i+1)
+}
+
+// chirpsWithIDs looks up each of ids.
+func (s *Schema) chirpsWithIDs(ids []int) []Chirp {
+	chirps := []Chirp{}
+	for _, id := range ids {
+		chirps = append(chirps, s.Chirps[id])
+	}
+	return chirps
+}
+
+// original returns the chirp a rechirp reposts, or chirp itself.
+func (s *Schema) original(chirp Chirp) Chirp {
+	original, ok := s.Chirps[chirp.RechirpOf]
+	if ok {
+		return original
+	}
+	return chirp
+}
+
+func (s *Schema) findRechirp(chirpID int, userID int) (Chirp, bool) {
+	id, ok := s.rechirps[chirpID][userID]
+	if !ok {
+		return Chirp{}, false
+	}
+	return s.Chirps[id], true
+}
+
+func (s *Schema) rechirpsOf(chirpID int) []Chirp {
+	chirps := []Chirp{}
+	for _, id := range s.rechirps[chirpID] {
+		chirps = append(chirps, s.Chirps[id])
+	}
+	return chirps
+}
+
+// uncount takes a rechirp or quote that is going away off the counts of
+// the chirp it reposts.
+func (s *Schema) uncount(chirp Chirp) []change {
+	originalID := chirp.RechirpOf
+	if originalID == 0 {
+		originalID = chirp.QuoteOf
+	}
+
+	original, ok := s.Chirps[originalID]
+	if !ok || originalID == 0 {
+		return nil
+	}
+
+	if chirp.RechirpOf != 0 {
+		original.RechirpCount--
+	} else {
+		original.QuoteCount--
+	}
+	s.putChirp(original)
+
+	return []change{putChange("chirps", original.ID, original)}
+}
+
+func (s *Schema) putLike(like Like) {
+	s.Likes[like.ID] = like
+	s.indexLike(like)
+}
+
+func (s *Schema) indexLike(like Like) {
+	byChirp, ok := s.likesByUser[like.UserID]
+	if !ok {
+		byChirp = map[int]int{}
+		s.likesByUser[like.UserID] = byChirp
+	}
+	byChirp[like.ChirpID] = like.ID
+
+	byUser, ok := s.likesByChirp[like.ChirpID]
+	if !ok {
+		byUser = map[int]int{}
+		s.likesByChirp[like.ChirpID] = byUser
+	}
+	byUser[like.UserID] = like.ID
+}
+
+func (s *Schema) removeLike(likeID int) {
+	like, ok := s.Likes[likeID]
+	if !ok {
+		return
+	}
+
+	delete(s.Likes, likeID)
+
+	delete(s.likesByUser[like.UserID], like.ChirpID)
+	if len(s.likesByUser[like.UserID]) == 0 {
+		delete(s.likesByUser, like.UserID)
+	}
+
+	delete(s.likesByChirp[like.ChirpID], like.UserID)
+	if len(s.likesByChirp[like.ChirpID]) == 0 {
+		delete(s.likesByChirp, like.ChirpID)
+	}
+}
+
+func (s *Schema) putFollow(follow Follow) {
+	s.Follows[follow.ID] = follow
+	s.indexFollow(follow)
+}
+
+func (s *Schema) indexFollow(follow Follow) {
+	followees, ok := s.following[follow.FollowerID]
+	if !ok {
+		followees = map[int]int{}
+		s.following[follow.FollowerID] = followees
+	}
+	followees[follow.FolloweeID] = follow.ID
+
+	followers, ok := s.followers[follow.FolloweeID]
+	if !ok {
+		followers = map[int]int{}
+		s.followers[follow.FolloweeID] = followers
+	}
+	followers[follow.FollowerID] = follow.ID
+}
+
+func (s *Schema) removeFollow(followID int) {
+	follow, ok := s.Follows[followID]
+	if !ok {
+		return
+	}
+
+	delete(s.Follows, followID)
+
+	delete(s.following[follow.FollowerID], follow.FolloweeID)
+	if len(s.following[follow.FollowerID]) == 0 {
+		delete(s.following, follow.FollowerID)
+	}
+
+	delete(s.followers[follow.FolloweeID], follow.FollowerID)
+	if len(s.followers[follow.FolloweeID]) == 0 {
+		delete(s.followers, follow.FolloweeID)
+	}
+}
+
+// putRevision records a new revision, IDs only increase so the per-chirp
+// index stays in order.
+func (s *Schema) putRevision(revision Revision) {
+	s.Revisions[revision.ID] = revision
+	s.revisionsByChirp[revision.ChirpID] = append(s.revisionsByChirp[revision.ChirpID], revision.ID)
+}
+
+// revisionsFor returns the revisions of chirpID, oldest first.
+func (s *Schema) revisionsFor(chirpID int) []Revision {
+	revisions := []Revision{}
+	for _, id := range s.revisionsByChirp[chirpID] {
+		revisions = append(revisions, s.Revisions[id])
+	}
+	return revisions
+}
+
+// chirpsFor returns the chirps by authorID, or every chirp for 0.
+func (s *Schema) chirpsFor(authorID int) []Chirp {
+	chirps := []Chirp{}
+
+	if authorID == 0 {
+		for _, chirp := range s.Chirps {
+			chirps = append(chirps, chirp)
+		}
+		return chirps
+	}
+
+	for _, id := range s.chirpsByAuthor[authorID] {
+		chirps = append(chirps, s.Chirps[id])
+	}
+	return chirps
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+const (
+	benchUsers          = 10000
+	benchChirpsPerUser  = 10
+	benchLookupAuthorID = benchUsers / 2
+)
+
+// newBenchDB fills a memory DB without going through CreateUser, which
+// would spend the whole benchmark setup in bcrypt.
+func newBenchDB() *DB {
+	db := NewMemoryDB()
+
+	id := 0
+	for userID := 1; userID <= benchUsers; userID++ {
+		db.schema.Users[userID] = User{
+			ID:    userID,
+			Email: fmt.Sprintf("user%d@example.com", userID),
+		}
+
+		for i := 0; i < benchChirpsPerUser; i++ {
+			id++
+			db.schema.Chirps[id] = Chirp{ID: id, AuthorID: userID, Body: "chirp"}
+		}
+	}
+	db.schema.buildIndexes()
+
+	return db
+}
+
+// scanUserByEmail and scanChirpsByAuthor are the linear scans the indexes
+// replaced, kept as a baseline.
+func scanUserByEmail(users map[int]User, email string) (User, bool) {
+	for _, user := range users {
+		if user.Email == email {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+func scanChirpsByAuthor(chirps map[int]Chirp, authorID int) []Chirp {
+	chirpList := []Chirp{}
+	for _, chirp := range chirps {
+		if chirp.AuthorID == authorID {
+			chirpList = append(chirpList, chirp)
+		}
+	}
+	sort.Slice(chirpList, func(i, j int) bool {
+		return chirpList[i].ID < chirpList[j].ID
+	})
+	return chirpList
+}
+
+func BenchmarkUserByEmail(b *testing.B) {
+	db := newBenchDB()
+	email := fmt.Sprintf("USER%d@example.com", benchLookupAuthorID)
+
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanUserByEmail(db.schema.Users, email)
+		}
+	})
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			db.schema.findUserByEmail(email)
+		}
+	})
+}
+
+func BenchmarkListChirpsByAuthor(b *testing.B) {
+	db := newBenchDB()
+
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanChirpsByAuthor(db.schema.Chirps, benchLookupAuthorID)
+		}
+	})
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			db.ListChirps(ChirpQuery{AuthorID: benchLookupAuthorID})
+		}
+	})
+}
+
+func TestIndexesFollowUpdates(t *testing.T) {
+	db := NewMemoryDB()
+
+	user, _ := db.CreateUser("old@example.com", "password")
+	db.CreateUser("taken@example.com", "password")
+
+	_, err := db.UpdateUser(user.ID, "Taken@example.com", "password")
+	if err == nil {
+		t.Errorf("Expected changing to another user's email to fail")
+	}
+
+	db.UpdateUser(user.ID, "new@example.com", "password")
+	if _, err := db.Login("old@example.com", "password"); err == nil {
+		t.Errorf("Expected the old email to be removed from the index")
+	}
+	if _, err := db.Login("NEW@example.com", "password"); err != nil {
+		t.Errorf("Expected the new email to be indexed: %v", err)
+	}
+
+	chirp, _ := db.CreateChirp(user.ID, "indexed")
+	db.DeleteChirp(user.ID, chirp.ID)
+	if len(db.schema.chirpsByAuthor[user.ID]) != 0 {
+		t.Errorf("Expected the deleted chirp to be removed from the author index")
+	}
+}
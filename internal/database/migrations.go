@@ -0,0 +1,950 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Migrator applies the ordered schema migrations for a backend.
+type Migrator interface {
+	// MigrateUp applies every pending migration.
+	MigrateUp() error
+	// MigrateDown rolls back the most recently applied migration.
+	MigrateDown() error
+	MigrationStatus() (MigrationStatus, error)
+	Close() error
+}
+
+type MigrationStatus struct {
+	Current    int
+	Latest     int
+	Migrations []MigrationState
+}
+
+type MigrationState struct {
+	Version int
+	Name    string
+	Applied bool
+}
+
+// jsonMigration transforms the raw decoded JSON file so it does not depend
+// on the current shape of Schema.
+type jsonMigration struct {
+	version int
+	name    string
+	up      func(data map[string]any) error
+	down    func(data map[string]any) error
+}
+
+var jsonMigrations = []jsonMigration{
+	{
+		version: 1,
+		name:    "initial schema",
+		up: func(data map[string]any) error {
+			for _, key := range []string{"chirps", "users", "refresh_tokens"} {
+				if data[key] == nil {
+					data[key] = map[string]any{}
+				}
+			}
+			return nil
+		},
+		down: func(data map[string]any) error {
+			return nil
+		},
+	},
+	{
+		version: 2,
+		name:    "id sequences",
+		up: func(data map[string]any) error {
+			// IDs used to be len+1, so the highest existing ID is the
+			// best record of what has been issued
+			sequences := map[string]any{}
+			for _, table := range []string{"chirps", "users"} {
+				last := 0
+				rows, _ := data[table].(map[string]any)
+				for key := range rows {
+					id, err := strconv.Atoi(key)
+					if err == nil && id > last {
+						last = id
+					}
+				}
+				sequences[table] = last
+			}
+			data["sequences"] = sequences
+			return nil
+		},
+		down: func(data map[string]any) error {
+			delete(data, "sequences")
+			return nil
+		},
+	},
+	{
+		version: 3,
+		name:    "timestamps",
+		up: func(data map[string]any) error {
+			// There's no record of when existing rows were made, so
+			// stamp them with the time of the migration
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+			for _, table := range []string{"chirps", "users"} {
+				rows, _ := data[table].(map[string]any)
+				for _, row := range rows {
+					row.(map[string]any)["created_at"] = now
+					row.(map[string]any)["updated_at"] = now
+				}
+			}
+			return nil
+		},
+		down: func(data map[string]any) error {
+			for _, table := range []string{"chirps", "users"} {
+				rows, _ := data[table].(map[string]any)
+				for _, row := range rows {
+					delete(row.(map[string]any), "created_at")
+					delete(row.(map[string]any), "updated_at")
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 4,
+		name:    "chirp revisions",
+		up: func(data map[string]any) error {
+			if data["revisions"] == nil {
+				data["revisions"] = map[string]any{}
+			}
+			return nil
+		},
+		down: func(data map[string]any) error {
+			delete(data, "revisions")
+			sequences, _ := data["sequences"].(map[string]any)
+			delete(sequences, "revisions")
+
+			rows, _ := data["chirps"].(map[string]any)
+			for _, row := range rows {
+				delete(row.(map[string]any), "edited")
+			}
+			return nil
+		},
+	},
+	{
+		version: 5,
+		name:    "likes",
+		up: func(data map[string]any) error {
+			if data["likes"] == nil {
+				data["likes"] = map[string]any{}
+			}
+			return nil
+		},
+		down: func(data map[string]any) error {
+			delete(data, "likes")
+			sequences, _ := data["sequences"].(map[string]any)
+			delete(sequences, "likes")
+
+			rows, _ := data["chirps"].(map[string]any)
+			for _, row := range rows {
+				delete(row.(map[string]any), "like_count")
+			}
+			return nil
+		},
+	},
+	{
+		version: 6,
+		name:    "follows",
+		up: func(data map[string]any) error {
+			if data["follows"] == nil {
+				data["follows"] = map[string]any{}
+			}
+			return nil
+		},
+		down: func(data map[string]any) error {
+			delete(data, "follows")
+			sequences, _ := data["sequences"].(map[string]any)
+			delete(sequences, "follows")
+			return nil
+		},
+	},
+	{
+		version: 7,
+		name:    "chirp entities",
+		up: func(data map[string]any) error {
+			// There are no handles yet, so mentions can only be by ID
+			users, _ := data["users"].(map[string]any)
+			rows, _ := data["chirps"].(map[string]any)
+			for _, row := range rows {
+				chirp := row.(map[string]any)
+				body, _ := chirp["body"].(string)
+				entities := resolveMentions(parseEntities(body), func(name string) int {
+					id, err := strconv.Atoi(name)
+					if err != nil || users[name] == nil {
+						return 0
+					}
+					return id
+				})
+
+				raw, err := json.Marshal(entities)
+				if err != nil {
+					return err
+				}
+				var value any
+				err = json.Unmarshal(raw, &value)
+				if err != nil {
+					return err
+				}
+				chirp["entities"] = value
+			}
+			return nil
+		},
+		down: func(data map[string]any) error {
+			rows, _ := data["chirps"].(map[string]any)
+			for _, row := range rows {
+				delete(row.(map[string]any), "entities")
+			}
+			return nil
+		},
+	},
+	{
+		version: 8,
+		name:    "user profiles",
+		up: func(data map[string]any) error {
+			rows, _ := data["users"].(map[string]any)
+			for _, row := range rows {
+				for _, field := range []string{"handle", "display_name", "bio", "avatar_url"} {
+					row.(map[string]any)[field] = ""
+				}
+			}
+			return nil
+		},
+		down: func(data map[string]any) error {
+			rows, _ := data["users"].(map[string]any)
+			for _, row := range rows {
+				for _, field := range []string{"handle", "display_name", "bio", "avatar_url"} {
+					delete(row.(map[string]any), field)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 9,
+		name:    "account deletion",
+		up: func(data map[string]any) error {
+			// Refresh tokens were only a revoked flag. Who they were
+			// issued to wasn't recorded, so they stay without an owner
+			tokens, _ := data["refresh_tokens"].(map[string]any)
+			for token, revoked := range tokens {
+				tokens[token] = map[string]any{"user_id": 0, "revoked": revoked}
+			}
+			return nil
+		},
+		down: func(data map[string]any) error {
+			tokens, _ := data["refresh_tokens"].(map[string]any)
+			for token, row := range tokens {
+				tokens[token] = row.(map[string]any)["revoked"]
+			}
+			rows, _ := data["users"].(map[string]any)
+			for _, row := range rows {
+				delete(row.(map[string]any), "deleted_at")
+			}
+			return nil
+		},
+	},
+	{
+		version: 10,
+		name:    "refresh token families",
+		up: func(data map[string]any) error {
+			// Existing tokens join a family when they are first rotated
+			tokens, _ := data["refresh_tokens"].(map[string]any)
+			for _, row := range tokens {
+				row.(map[string]any)["family"] = ""
+				row.(map[string]any)["rotated"] = false
+			}
+			return nil
+		},
+		down: func(data map[string]any) error {
+			tokens, _ := data["refresh_tokens"].(map[string]any)
+			for _, row := range tokens {
+				delete(row.(map[string]any), "family")
+				delete(row.(map[string]any), "rotated")
+			}
+			return nil
+		},
+	},
+	{
+		version: 11,
+		name:    "sessions",
+		up: func(data map[string]any) error {
+			// Families already rotated become sessions with nothing known
+			// about their device
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+			sessions := map[string]any{}
+			tokens, _ := data["refresh_tokens"].(map[string]any)
+			for _, row := range tokens {
+				token := row.(map[string]any)
+				family, _ := token["family"].(string)
+				if family == "" || token["revoked"] == true {
+					continue
+				}
+				sessions[family] = map[string]any{
+					"id":           family,
+					"user_id":      token["user_id"],
+					"device_name":  "",
+					"user_agent":   "",
+					"ip":           "",
+					"created_at":   now,
+					"last_used_at": now,
+				}
+			}
+			data["sessions"] = sessions
+			return nil
+		},
+		down: func(data map[string]any) error {
+			delete(data, "sessions")
+			return nil
+		},
+	},
+	{
+		version: 12,
+		name:    "refresh token expiry",
+		up: func(data map[string]any) error {
+			// Refresh tokens were issued for at most 60 days, so the
+			// existing ones are done by 60 days from now
+			expiresAt := time.Now().UTC().Add(60 * 24 * time.Hour).Format(time.RFC3339Nano)
+			for _, table := range []string{"refresh_tokens", "sessions"} {
+				rows, _ := data[table].(map[string]any)
+				for _, row := range rows {
+					row.(map[string]any)["expires_at"] = expiresAt
+				}
+			}
+			return nil
+		},
+		down: func(data map[string]any) error {
+			for _, table := range []string{"refresh_tokens", "sessions"} {
+				rows, _ := data[table].(map[string]any)
+				for _, row := range rows {
+					delete(row.(map[string]any), "expires_at")
+				}
+			}
+			return nil
+		},
+	},
+}
+
+type sqlMigration struct {
+	version int
+	name    string
+	up      string
+	down    string
+	// backfill, if set, runs after up for data SQL alone can't migrate
+	backfill func(tx *sql.Tx) error
+}
+
+var sqlMigrations = []sqlMigration{
+	{
+		version: 1,
+		name:    "initial schema",
+		up: `
+CREATE TABLE IF NOT EXISTS users (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	email         TEXT    NOT NULL,
+	password      TEXT    NOT NULL,
+	is_chirpy_red INTEGER NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_email ON users (email);
+
+CREATE TABLE IF NOT EXISTS chirps (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	author_id INTEGER NOT NULL,
+	body      TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS chirps_author_id ON chirps (author_id);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token   TEXT    PRIMARY KEY,
+	revoked INTEGER NOT NULL DEFAULT 0
+);
+`,
+		down: `
+DROP TABLE refresh_tokens;
+DROP TABLE chirps;
+DROP TABLE users;
+`,
+	},
+	{
+		version: 2,
+		name:    "case-insensitive email index",
+		up: `
+DROP INDEX users_email;
+CREATE UNIQUE INDEX users_email ON users (email COLLATE NOCASE);
+`,
+		down: `
+DROP INDEX users_email;
+CREATE UNIQUE INDEX users_email ON users (email);
+`,
+	},
+	{
+		version: 3,
+		name:    "timestamps",
+		up: `
+ALTER TABLE chirps ADD COLUMN created_at DATETIME;
+ALTER TABLE chirps ADD COLUMN updated_at DATETIME;
+UPDATE chirps SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP;
+CREATE INDEX chirps_created_at ON chirps (created_at);
+
+ALTER TABLE users ADD COLUMN created_at DATETIME;
+ALTER TABLE users ADD COLUMN updated_at DATETIME;
+UPDATE users SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP;
+`,
+		down: `
+DROP INDEX chirps_created_at;
+ALTER TABLE chirps DROP COLUMN created_at;
+ALTER TABLE chirps DROP COLUMN updated_at;
+
+ALTER TABLE users DROP COLUMN created_at;
+ALTER TABLE users DROP COLUMN updated_at;
+`,
+	},
+	{
+		version: 4,
+		name:    "chirp search",
+		up: `
+CREATE VIRTUAL TABLE chirps_fts USING fts5 (body, content = 'chirps', content_rowid = 'id');
+INSERT INTO chirps_fts (chirps_fts) VALUES ('rebuild');
+
+CREATE TRIGGER chirps_fts_insert AFTER INSERT ON chirps BEGIN
+	INSERT INTO chirps_fts (rowid, body) VALUES (new.id, new.body);
+END;
+CREATE TRIGGER chirps_fts_delete AFTER DELETE ON chirps BEGIN
+	INSERT INTO chirps_fts (chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+END;
+CREATE TRIGGER chirps_fts_update AFTER UPDATE OF body ON chirps BEGIN
+	INSERT INTO chirps_fts (chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+	INSERT INTO chirps_fts (rowid, body) VALUES (new.id, new.body);
+END;
+`,
+		down: `
+DROP TRIGGER chirps_fts_insert;
+DROP TRIGGER chirps_fts_delete;
+DROP TRIGGER chirps_fts_update;
+DROP TABLE chirps_fts;
+`,
+	},
+	{
+		version: 5,
+		name:    "chirp revisions",
+		up: `
+ALTER TABLE chirps ADD COLUMN edited BOOLEAN NOT NULL DEFAULT 0;
+
+CREATE TABLE chirp_revisions (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	chirp_id   INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	body       TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+CREATE INDEX chirp_revisions_chirp_id ON chirp_revisions (chirp_id);
+`,
+		down: `
+DROP TABLE chirp_revisions;
+ALTER TABLE chirps DROP COLUMN edited;
+`,
+	},
+	{
+		version: 6,
+		name:    "chirp replies",
+		up: `
+ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chirps ADD COLUMN root_id INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX chirps_in_reply_to ON chirps (in_reply_to);
+`,
+		down: `
+DROP INDEX chirps_in_reply_to;
+ALTER TABLE chirps DROP COLUMN in_reply_to;
+ALTER TABLE chirps DROP COLUMN root_id;
+`,
+	},
+	{
+		version: 7,
+		name:    "rechirps and quotes",
+		up: `
+ALTER TABLE chirps ADD COLUMN rechirp_of INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chirps ADD COLUMN quote_of INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chirps ADD COLUMN rechirp_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chirps ADD COLUMN quote_count INTEGER NOT NULL DEFAULT 0;
+CREATE UNIQUE INDEX chirps_rechirp_of ON chirps (rechirp_of, author_id) WHERE rechirp_of != 0;
+CREATE INDEX chirps_quote_of ON chirps (quote_of) WHERE quote_of != 0;
+`,
+		down: `
+DROP INDEX chirps_rechirp_of;
+DROP INDEX chirps_quote_of;
+ALTER TABLE chirps DROP COLUMN rechirp_of;
+ALTER TABLE chirps DROP COLUMN quote_of;
+ALTER TABLE chirps DROP COLUMN rechirp_count;
+ALTER TABLE chirps DROP COLUMN quote_count;
+`,
+	},
+	{
+		version: 8,
+		name:    "likes",
+		up: `
+ALTER TABLE chirps ADD COLUMN like_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE likes (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id    INTEGER NOT NULL,
+	chirp_id   INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	created_at DATETIME NOT NULL,
+	UNIQUE (user_id, chirp_id)
+);
+CREATE INDEX likes_chirp_id ON likes (chirp_id);
+`,
+		down: `
+DROP TABLE likes;
+ALTER TABLE chirps DROP COLUMN like_count;
+`,
+	},
+	{
+		version: 9,
+		name:    "follows",
+		up: `
+CREATE TABLE follows (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	follower_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	followee_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	created_at  DATETIME NOT NULL,
+	UNIQUE (follower_id, followee_id)
+);
+CREATE INDEX follows_followee_id ON follows (followee_id);
+`,
+		down: `
+DROP TABLE follows;
+`,
+	},
+	{
+		version: 10,
+		name:    "chirp entities",
+		up: `
+ALTER TABLE chirps ADD COLUMN entities TEXT NOT NULL DEFAULT '[]';
+
+CREATE TABLE chirp_hashtags (
+	tag      TEXT NOT NULL,
+	chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	PRIMARY KEY (tag, chirp_id)
+);
+CREATE INDEX chirp_hashtags_chirp_id ON chirp_hashtags (chirp_id);
+
+CREATE TABLE chirp_mentions (
+	user_id  INTEGER NOT NULL,
+	chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	PRIMARY KEY (user_id, chirp_id)
+);
+CREATE INDEX chirp_mentions_chirp_id ON chirp_mentions (chirp_id);
+`,
+		down: `
+DROP TABLE chirp_mentions;
+DROP TABLE chirp_hashtags;
+ALTER TABLE chirps DROP COLUMN entities;
+`,
+		backfill: backfillEntities,
+	},
+	{
+		version: 11,
+		name:    "user profiles",
+		up: `
+ALTER TABLE users ADD COLUMN handle TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX users_handle ON users (handle COLLATE NOCASE) WHERE handle != '';
+`,
+		down: `
+DROP INDEX users_handle;
+ALTER TABLE users DROP COLUMN avatar_url;
+ALTER TABLE users DROP COLUMN bio;
+ALTER TABLE users DROP COLUMN display_name;
+ALTER TABLE users DROP COLUMN handle;
+`,
+	},
+	{
+		version: 12,
+		name:    "account deletion",
+		up: `
+ALTER TABLE users ADD COLUMN deleted_at DATETIME;
+CREATE INDEX users_deleted_at ON users (deleted_at) WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE refresh_tokens ADD COLUMN user_id INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX refresh_tokens_user_id ON refresh_tokens (user_id);
+`,
+		down: `
+DROP INDEX refresh_tokens_user_id;
+ALTER TABLE refresh_tokens DROP COLUMN user_id;
+
+DROP INDEX users_deleted_at;
+ALTER TABLE users DROP COLUMN deleted_at;
+`,
+	},
+	{
+		version: 13,
+		name:    "refresh token families",
+		up: `
+ALTER TABLE refresh_tokens ADD COLUMN family TEXT NOT NULL DEFAULT '';
+ALTER TABLE refresh_tokens ADD COLUMN rotated INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX refresh_tokens_family ON refresh_tokens (user_id, family);
+`,
+		down: `
+DROP INDEX refresh_tokens_family;
+ALTER TABLE refresh_tokens DROP COLUMN rotated;
+ALTER TABLE refresh_tokens DROP COLUMN family;
+`,
+	},
+	{
+		version: 14,
+		name:    "sessions",
+		up: `
+CREATE TABLE sessions (
+	id           TEXT     PRIMARY KEY,
+	user_id      INTEGER  NOT NULL,
+	device_name  TEXT     NOT NULL DEFAULT '',
+	user_agent   TEXT     NOT NULL DEFAULT '',
+	ip           TEXT     NOT NULL DEFAULT '',
+	created_at   DATETIME NOT NULL,
+	last_used_at DATETIME NOT NULL
+);
+CREATE INDEX sessions_user_id ON sessions (user_id);
+
+INSERT INTO sessions (id, user_id, created_at, last_used_at)
+SELECT family, MIN(user_id), CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+FROM refresh_tokens WHERE family != '' AND revoked = 0 GROUP BY family;
+`,
+		down: `
+DROP TABLE sessions;
+`,
+	},
+	{
+		version: 15,
+		name:    "refresh token expiry",
+		up: `
+ALTER TABLE refresh_tokens ADD COLUMN expires_at DATETIME;
+UPDATE refresh_tokens SET expires_at = datetime('now', '+60 days');
+CREATE INDEX refresh_tokens_expires_at ON refresh_tokens (expires_at);
+
+ALTER TABLE sessions ADD COLUMN expires_at DATETIME;
+UPDATE sessions SET expires_at = datetime('now', '+60 days');
+CREATE INDEX sessions_expires_at ON sessions (expires_at);
+`,
+		down: `
+DROP INDEX sessions_expires_at;
+ALTER TABLE sessions DROP COLUMN expires_at;
+
+DROP INDEX refresh_tokens_expires_at;
+ALTER TABLE refresh_tokens DROP COLUMN expires_at;
+`,
+	},
+}
+
+// NewMigrator returns the Migrator for the backend selected by cfg.
+func NewMigrator(cfg Config) (Migrator, error) {
+	switch cfg.Driver {
+	case "", "json":
+		return jsonMigrator{path: cfg.path()}, nil
+	case "sqlite":
+		db, err := NewSQLiteDB(cfg.path())
+		if err != nil {
+			return nil, err
+		}
+		return sqliteMigrator{db: db.db}, nil
+	}
+
+	return nil, errors.New("no migrations for database driver " + cfg.Driver)
+}
+
+// jsonMigrator migrates the JSON file, keeping the schema version in its
+// "version" field.
+type jsonMigrator struct {
+	path string
+}
+
+func (jm jsonMigrator) read() (map[string]any, int, error) {
+	data, err := readSnapshot(jm.path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	version, _ := data["version"].(float64)
+	return data, int(version), nil
+}
+
+// write saves data as a new snapshot, folding in the write-ahead log that
+// read already replayed.
+func (jm jsonMigrator) write(data map[string]any, version int) error {
+	data["version"] = version
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return errors.New("could not encode database")
+	}
+
+	err = writeFileAtomic(jm.path, raw)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(walPath(jm.path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.New("could not remove write-ahead log")
+	}
+
+	return nil
+}
+
+func (jm jsonMigrator) MigrateUp() error {
+	data, version, err := jm.read()
+	if err != nil {
+		return err
+	}
+
+	if version == len(jsonMigrations) {
+		return nil
+	}
+
+	for _, m := range jsonMigrations[version:] {
+		err = m.up(data)
+		if err != nil {
+			return err
+		}
+		log.Printf("applied migration %d: %s", m.version, m.name)
+	}
+
+	return jm.write(data, len(jsonMigrations))
+}
+
+func (jm jsonMigrator) MigrateDown() error {
+	data, version, err := jm.read()
+	if err != nil {
+		return err
+	}
+
+	if version == 0 {
+		return errors.New("no migrations to roll back")
+	}
+
+	m := jsonMigrations[version-1]
+	err = m.down(data)
+	if err != nil {
+		return err
+	}
+	log.Printf("rolled back migration %d: %s", m.version, m.name)
+
+	return jm.write(data, version-1)
+}
+
+func (jm jsonMigrator) MigrationStatus() (MigrationStatus, error) {
+	_, version, err := jm.read()
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	status := MigrationStatus{
+		Current: version,
+		Latest:  len(jsonMigrations),
+	}
+	for _, m := range jsonMigrations {
+		status.Migrations = append(status.Migrations, MigrationState{
+			Version: m.version,
+			Name:    m.name,
+			Applied: m.version <= version,
+		})
+	}
+
+	return status, nil
+}
+
+func (jm jsonMigrator) Close() error {
+	return nil
+}
+
+// backfillEntities parses the chirps posted before entities were extracted
+// and adds them to the hashtag and mention indexes. There are no handles yet,
+// so mentions can only be by ID.
+func backfillEntities(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, body FROM chirps")
+	if err != nil {
+		return err
+	}
+
+	bodies := map[int]string{}
+	for rows.Next() {
+		var id int
+		var body string
+		err = rows.Scan(&id, &body)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		bodies[id] = body
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for id, body := range bodies {
+		entities := resolveMentions(parseEntities(body), func(name string) int {
+			userID, err := strconv.Atoi(name)
+			if err == nil {
+				err = tx.QueryRow("SELECT id FROM users WHERE id = ?", userID).Scan(&userID)
+			}
+			if err != nil {
+				return 0
+			}
+			return userID
+		})
+		if len(entities) == 0 {
+			continue
+		}
+
+		raw, err := json.Marshal(entities)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE chirps SET entities = ? WHERE id = ?", string(raw), id)
+		if err != nil {
+			return err
+		}
+
+		for _, tag := range hashtags(entities) {
+			_, err = tx.Exec("INSERT INTO chirp_hashtags (tag, chirp_id) VALUES (?, ?)", tag, id)
+			if err != nil {
+				return err
+			}
+		}
+		for _, userID := range mentions(entities) {
+			_, err = tx.Exec("INSERT INTO chirp_mentions (user_id, chirp_id) VALUES (?, ?)", userID, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// sqliteMigrator records applied migrations in the schema_migrations table.
+type sqliteMigrator struct {
+	db *sql.DB
+}
+
+func (sm sqliteMigrator) version() (int, error) {
+	_, err := sm.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER  PRIMARY KEY,
+	name       TEXT     NOT NULL,
+	applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`)
+	if err != nil {
+		log.Println(err)
+		return 0, errors.New("could not create the migrations table")
+	}
+
+	version := 0
+	err = sm.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		log.Println(err)
+		return 0, errors.New("could not read the schema version")
+	}
+
+	return version, nil
+}
+
+func (sm sqliteMigrator) apply(statements string, backfill func(tx *sql.Tx) error, record string, args ...any) error {
+	tx, err := sm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(statements)
+	if err != nil {
+		return err
+	}
+
+	if backfill != nil {
+		err = backfill(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(record, args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (sm sqliteMigrator) MigrateUp() error {
+	version, err := sm.version()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range sqlMigrations[version:] {
+		err = sm.apply(m.up, m.backfill, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name)
+		if err != nil {
+			log.Println(err)
+			return errors.New("could not apply migration " + m.name)
+		}
+		log.Printf("applied migration %d: %s", m.version, m.name)
+	}
+
+	return nil
+}
+
+func (sm sqliteMigrator) MigrateDown() error {
+	version, err := sm.version()
+	if err != nil {
+		return err
+	}
+
+	if version == 0 {
+		return errors.New("no migrations to roll back")
+	}
+
+	m := sqlMigrations[version-1]
+	err = sm.apply(m.down, nil, "DELETE FROM schema_migrations WHERE version = ?", m.version)
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not roll back migration " + m.name)
+	}
+	log.Printf("rolled back migration %d: %s", m.version, m.name)
+
+	return nil
+}
+
+func (sm sqliteMigrator) MigrationStatus() (MigrationStatus, error) {
+	version, err := sm.version()
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	status := MigrationStatus{
+		Current: version,
+		Latest:  len(sqlMigrations),
+	}
+	for _, m := range sqlMigrations {
+		status.Migrations = append(status.Migrations, MigrationState{
+			Version: m.version,
+			Name:    m.name,
+			Applied: m.version <= version,
+		})
+	}
+
+	return status, nil
+}
+
+func (sm sqliteMigrator) Close() error {
+	return sm.db.Close()
+}
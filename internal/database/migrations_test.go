@@ -0,0 +1,147 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	// A file written before versioning has no version field
+	err := os.WriteFile(path, []byte(`{"chirps":{"1":{"id":1,"author_id":1,"body":"hi"}}}`), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = Open(Config{Path: path})
+	if err == nil {
+		t.Errorf("Expected opening an unmigrated database to fail")
+	}
+
+	m := jsonMigrator{path: path}
+	err = m.MigrateUp()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	status, err := m.MigrationStatus()
+	if err != nil || status.Current != len(jsonMigrations) {
+		t.Errorf("Expected version %v but got %v (%v)", len(jsonMigrations), status.Current, err)
+	}
+
+	db, err := Open(Config{Path: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	chirp, err := db.ReadChirp(1)
+	if err != nil || chirp.Body != "hi" {
+		t.Errorf("Expected the chirp to survive migrating but got '%v' (%v)", chirp, err)
+	}
+
+	for range jsonMigrations {
+		err = m.MigrateDown()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	err = m.MigrateDown()
+	if err == nil {
+		t.Errorf("Expected rolling back past version 0 to fail")
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	m := sqliteMigrator{db: db.db}
+
+	status, err := m.MigrationStatus()
+	if err != nil || status.Current != len(sqlMigrations) {
+		t.Errorf("Expected version %v but got %v (%v)", len(sqlMigrations), status.Current, err)
+	}
+
+	for range sqlMigrations {
+		err = m.MigrateDown()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	status, _ = m.MigrationStatus()
+	if status.Current != 0 {
+		t.Errorf("Expected version 0 but got %v", status.Current)
+	}
+
+	err = m.MigrateUp()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestJSONMigrationBackfillsEntities(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	err := os.WriteFile(path, []byte(`{"users":{"1":{"id":1,"email":"a@example.com"}},"chirps":{"1":{"id":1,"author_id":1,"body":"#Go hi @1"}}}`), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = jsonMigrator{path: path}.MigrateUp()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	db, err := Open(Config{Path: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkBackfilledEntities(t, db)
+}
+
+func TestSQLiteMigrationBackfillsEntities(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	m := sqliteMigrator{db: db.db}
+
+	// Go back to just before entities were extracted
+	for version := len(sqlMigrations); version > 9; version-- {
+		err := m.MigrateDown()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	_, err := db.db.Exec(`
+INSERT INTO users (id, email, password, created_at, updated_at) VALUES (1, 'a@example.com', '', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP);
+INSERT INTO chirps (id, author_id, body, created_at, updated_at) VALUES (1, 1, '#Go hi @1', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP);
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = m.MigrateUp()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkBackfilledEntities(t, db)
+}
+
+func checkBackfilledEntities(t *testing.T, db Store) {
+	t.Helper()
+
+	chirp, err := db.ReadChirp(1)
+	if err != nil || len(chirp.Entities) != 2 {
+		t.Errorf("Expected the existing chirp to be parsed but got '%v' (%v)", chirp, err)
+	}
+
+	for _, query := range []ChirpQuery{{Hashtag: "go"}, {Mentions: 1}} {
+		page, err := db.ListChirps(query)
+		if err != nil || len(page.Chirps) != 1 {
+			t.Errorf("Expected %+v to find the existing chirp but got %v (%v)", query, page.Chirps, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrHandleTaken = errors.New("handle already taken")
+
+// handlePattern is what a handle may look like. Handles can't be all digits
+// so they never clash with user IDs in mentions and profile URLs.
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,15}$`)
+
+// ValidHandle reports whether handle can be claimed.
+func ValidHandle(handle string) bool {
+	return handlePattern.MatchString(handle) && strings.Trim(handle, "0123456789") != ""
+}
+
+// handleKey makes handle lookups case-insensitive.
+func handleKey(handle string) string {
+	return strings.ToLower(strings.TrimPrefix(handle, "@"))
+}
+
+// Profile is the public side of a User, it never includes their email.
+type Profile struct {
+	ID          int       `json:"id"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	AvatarURL   string    `json:"avatar_url"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (user User) Profile() Profile {
+	return Profile{
+		ID:          user.ID,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarURL,
+		IsChirpyRed: user.IsChirpyRed,
+		CreatedAt:   user.CreatedAt,
+	}
+}
+
+// ProfileUpdate changes the profile fields that aren't nil. An empty Handle
+// gives the handle up.
+type ProfileUpdate struct {
+	Handle      *string
+	DisplayName *string
+	Bio         *string
+	AvatarURL   *string
+}
+
+func (update ProfileUpdate) apply(user User) User {
+	if update.Handle != nil {
+		user.Handle = strings.TrimPrefix(*update.Handle, "@")
+	}
+	if update.DisplayName != nil {
+		user.DisplayName = *update.DisplayName
+	}
+	if update.Bio != nil {
+		user.Bio = *update.Bio
+	}
+	if update.AvatarURL != nil {
+		user.AvatarURL = *update.AvatarURL
+	}
+	return user
+}
@@ -0,0 +1,296 @@
+package database
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ErrEmptySearch is returned for a search query without any terms.
+var ErrEmptySearch = errors.New("empty search query")
+
+// SearchQuery is a full-text search over chirp bodies. Query is a list of
+// words that must all match. "Quoted words" must appear together as a
+// phrase and a trailing * matches any word with that prefix.
+type SearchQuery struct {
+	Query    string
+	AuthorID int
+	Limit    int
+	Cursor   string
+}
+
+// searchClause is one part of a parsed query: a single term, a phrase of
+// several consecutive terms, or a prefix.
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+// tokenize splits text into lowercase words of letters and digits, the same
+// way SQLite's unicode61 tokenizer does.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func parseSearch(query string) ([]searchClause, error) {
+	clauses := []searchClause{}
+
+	// Quotes alternate between loose words and phrases
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 1 {
+			terms := tokenize(part)
+			if len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			prefix := strings.HasSuffix(word, "*")
+			for _, term := range tokenize(word) {
+				clauses = append(clauses, searchClause{terms: []string{term}})
+			}
+			if prefix && len(clauses) > 0 {
+				clauses[len(clauses)-1].prefix = true
+			}
+		}
+	}
+
+	if len(clauses) == 0 {
+		return nil, ErrEmptySearch
+	}
+
+	return clauses, nil
+}
+
+// ftsMatch renders clauses as an SQLite FTS5 MATCH expression.
+func ftsMatch(clauses []searchClause) string {
+	parts := []string{}
+	for _, clause := range clauses {
+		part := `"` + strings.Join(clause.terms, " ") + `"`
+		if clause.prefix {
+			part += "*"
+		}
+		parts = append(parts, part)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// searchIndex is an in-memory inverted index of chirp bodies.
+type searchIndex struct {
+	// postings maps each term to the chirps containing it and the positions
+	// it appears at within each
+	postings map[string]map[int][]int
+	// terms is every indexed term in order, for prefix lookups
+	terms       []string
+	lengths     map[int]int
+	totalLength int
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: map[string]map[int][]int{},
+		terms:    []string{},
+		lengths:  map[int]int{},
+	}
+}
+
+func (idx *searchIndex) add(id int, body string) {
+	tokens := tokenize(body)
+
+	for position, term := range tokens {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = map[int][]int{}
+			idx.postings[term] = docs
+
+			i, _ := slices.BinarySearch(idx.terms, term)
+			idx.terms = slices.Insert(idx.terms, i, term)
+		}
+		docs[id] = append(docs[id], position)
+	}
+
+	idx.lengths[id] = len(tokens)
+	idx.totalLength += len(tokens)
+}
+
+func (idx *searchIndex) remove(id int, body string) {
+	for _, term := range tokenize(body) {
+		docs := idx.postings[term]
+		delete(docs, id)
+
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+
+			i, found := slices.BinarySearch(idx.terms, term)
+			if found {
+				idx.terms = slices.Delete(idx.terms, i, i+1)
+			}
+		}
+	}
+
+	idx.totalLength -= idx.lengths[id]
+	delete(idx.lengths, id)
+}
+
+// matches returns how often clause occurs in each chirp that contains it.
+func (idx *searchIndex) matches(clause searchClause) map[int]int {
+	counts := map[int]int{}
+
+	if clause.prefix && len(clause.terms) == 1 {
+		prefix := clause.terms[0]
+		i, _ := slices.BinarySearch(idx.terms, prefix)
+		for ; i < len(idx.terms) && strings.HasPrefix(idx.terms[i], prefix); i++ {
+			for id, positions := range idx.postings[idx.terms[i]] {
+				counts[id] += len(positions)
+			}
+		}
+		return counts
+	}
+
+	// A phrase matches wherever each following term sits one position
+	// after the one before it
+	first := clause.terms[0]
+	for id, positions := range idx.postings[first] {
+		for _, start := range positions {
+			if idx.phraseAt(id, start, clause) {
+				counts[id]++
+			}
+		}
+	}
+
+	return counts
+}
+
+func (idx *searchIndex) phraseAt(id int, start int, clause searchClause) bool {
+	for offset, term := range clause.terms[1:] {
+		last := offset == len(clause.terms)-2
+
+		found := false
+		candidates := []string{term}
+		if clause.prefix && last {
+			candidates = idx.withPrefix(term)
+		}
+		for _, candidate := range candidates {
+			if slices.Contains(idx.postings[candidate][id], start+offset+1) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (idx *searchIndex) withPrefix(prefix string) []string {
+	i, _ := slices.BinarySearch(idx.terms, prefix)
+	j := i
+	for j < len(idx.terms) && strings.HasPrefix(idx.terms[j], prefix) {
+		j++
+	}
+
+	return idx.terms[i:j]
+}
+
+// searchHit is a matching chirp and its relevance, higher is better.
+type searchHit struct {
+	id    int
+	score float64
+}
+
+// search returns the chirps matching every clause, most relevant first and
+// newest first among equals. Scores use BM25 like SQLite's FTS5.
+func (idx *searchIndex) search(clauses []searchClause, keep func(id int) bool) []searchHit {
+	const k1, b = 1.2, 0.75
+
+	docs := float64(len(idx.lengths))
+	if docs == 0 {
+		return []searchHit{}
+	}
+	avgLength := float64(idx.totalLength) / docs
+
+	scores := map[int]float64{}
+	for i, clause := range clauses {
+		counts := idx.matches(clause)
+		idf := math.Log(1 + (docs-float64(len(counts))+0.5)/(float64(len(counts))+0.5))
+
+		next := map[int]float64{}
+		for id, count := range counts {
+			if _, ok := scores[id]; i > 0 && !ok {
+				continue
+			}
+			if !keep(id) {
+				continue
+			}
+
+			tf := float64(count)
+			norm := 1 - b + b*float64(idx.lengths[id])/avgLength
+			next[id] = scores[id] + idf*tf*(k1+1)/(tf+k1*norm)
+		}
+		scores = next
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, searchHit{id: id, score: score})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].before(hits[j])
+	})
+
+	return hits
+}
+
+func (hit searchHit) before(other searchHit) bool {
+	if hit.score != other.score {
+		return hit.score > other.score
+	}
+	return hit.id > other.id
+}
+
+// searchCursor is the last hit of a page. Relevance depends on the rest of
+// the corpus, so pages are only stable while the matching chirps are.
+type searchCursor struct {
+	Query    string  `json:"q"`
+	AuthorID int     `json:"a"`
+	Score    float64 `json:"s"`
+	ID       int     `json:"id"`
+}
+
+func (query SearchQuery) decodeCursor() (*searchCursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	c := searchCursor{}
+	err := decodeCursor(query.Cursor, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Query != query.Query || c.AuthorID != query.AuthorID {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+func (query SearchQuery) nextCursor(score float64, id int) string {
+	return encodeCursor(searchCursor{
+		Query:    query.Query,
+		AuthorID: query.AuthorID,
+		Score:    score,
+		ID:       id,
+	})
+}
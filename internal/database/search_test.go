@@ -0,0 +1,81 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestSearchChirps(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		db.CreateChirp(1, "I love kittens")           // 1
+		db.CreateChirp(1, "Kittens love me")          // 2
+		db.CreateChirp(2, "kitten pictures, kitten!") // 3
+		db.CreateChirp(2, "Nothing to see here")      // 4
+		db.CreateChirp(1, "deleted kittens")          // 5
+		db.DeleteChirp(1, 5)
+
+		cases := []struct {
+			query    SearchQuery
+			expected string
+		}{
+			{SearchQuery{Query: "KITTENS"}, "[2 1]"},
+			{SearchQuery{Query: "love kittens"}, "[2 1]"},
+			{SearchQuery{Query: `"love kittens"`}, "[1]"},
+			{SearchQuery{Query: "kitten"}, "[3]"},
+			{SearchQuery{Query: "kit*"}, "[3 2 1]"},
+			{SearchQuery{Query: "kit*", AuthorID: 1}, "[2 1]"},
+			{SearchQuery{Query: "puppies"}, "[]"},
+		}
+
+		for _, c := range cases {
+			page, err := db.SearchChirps(c.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if chirpIDs(page.Chirps) != c.expected {
+				t.Errorf("Expected %+v to find %v but got %v", c.query, c.expected, chirpIDs(page.Chirps))
+			}
+		}
+
+		_, err := db.SearchChirps(SearchQuery{Query: " * "})
+		if err != ErrEmptySearch {
+			t.Errorf("Expected an empty search to be rejected but got %v", err)
+		}
+	})
+}
+
+func TestSearchChirpsPagination(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		for i := 0; i < 5; i++ {
+			db.CreateChirp(1, "chirp chirp")
+			db.CreateChirp(1, "a chirp")
+		}
+
+		query := SearchQuery{Query: "chirp"}
+		all, _ := db.SearchChirps(query)
+
+		paged := []Chirp{}
+		query.Limit = 3
+		for {
+			page, err := db.SearchChirps(query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			paged = append(paged, page.Chirps...)
+
+			if page.NextCursor == "" {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+
+		if len(all.Chirps) != 10 || chirpIDs(paged) != chirpIDs(all.Chirps) {
+			t.Errorf("Expected pages to add up to %v but got %v", chirpIDs(all.Chirps), chirpIDs(paged))
+		}
+
+		query.Query = "other"
+		_, err := db.SearchChirps(query)
+		if err != ErrInvalidCursor {
+			t.Errorf("Expected a cursor for another query to be rejected but got %v", err)
+		}
+	})
+}
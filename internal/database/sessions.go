@@ -0,0 +1,100 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Device describes what a session was started or last used from.
+type Device struct {
+	Name      string
+	UserAgent string
+	IP        string
+}
+
+// Session is a login on one device. Its ID is the family of the refresh
+// tokens rotated from that login, so ending it revokes them all.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	DeviceName string    `json:"device_name"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// ExpiresAt is when its latest refresh token expires
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// use records that session was used from device just now and was issued a
+// refresh token lasting until expiresAt. The device name is only set when
+// the session starts, unless it had none.
+func (session Session) use(device Device, now time.Time, expiresAt time.Time) Session {
+	if session.DeviceName == "" {
+		session.DeviceName = device.Name
+	}
+	session.UserAgent = device.UserAgent
+	session.IP = device.IP
+	session.LastUsedAt = now
+	session.ExpiresAt = expiresAt.UTC()
+	return session
+}
+
+func (session Session) expired(now time.Time) bool {
+	return !now.Before(session.ExpiresAt)
+}
+
+// sortSessions puts the most recently used sessions first.
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+}
+
+// endSession revokes the refresh tokens in the family of session ID and
+// removes the session. It returns the changes to persist.
+func (s *Schema) endSession(userID int, id string) []change {
+	changes := []change{}
+	for token := range s.refreshTokensByUser[userID] {
+		refreshToken := s.RefreshTokens[token]
+		if refreshToken.Family != id || refreshToken.Revoked {
+			continue
+		}
+		refreshToken.Revoked = true
+		s.putRefreshToken(token, refreshToken)
+		changes = append(changes, putChange("refresh_tokens", token, refreshToken))
+	}
+
+	if _, ok := s.Sessions[id]; ok {
+		s.removeSession(id)
+		changes = append(changes, deleteChange("sessions", id))
+	}
+	return changes
+}
+
+// endSessions logs userID out everywhere, including tokens issued before
+// sessions were recorded.
+func (s *Schema) endSessions(userID int) []change {
+	changes := []change{}
+	for token := range s.refreshTokensByUser[userID] {
+		refreshToken := s.RefreshTokens[token]
+		if refreshToken.Revoked {
+			continue
+		}
+		refreshToken.Revoked = true
+		s.putRefreshToken(token, refreshToken)
+		changes = append(changes, putChange("refresh_tokens", token, refreshToken))
+	}
+
+	for id := range s.sessionsByUser[userID] {
+		s.removeSession(id)
+		changes = append(changes, deleteChange("sessions", id))
+	}
+	return changes
+}
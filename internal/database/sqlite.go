@@ -0,0 +1,1900 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDB is a Store backed by a SQLite database file. It uses the pure Go
+// modernc.org/sqlite driver so it builds without cgo. Tables are created by
+// the migrations in sqlMigrations.
+type SQLiteDB struct {
+	db  *sql.DB
+	ids string
+	// trends is kept in memory, see loadTrends
+	trends *trendTracker
+}
+
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_time_format=sqlite"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		log.Println(err)
+		return nil, errors.New("could not open the database")
+	}
+
+	// SQLite only allows a single writer, so serialise access through one
+	// connection rather than fighting over the file lock.
+	db.SetMaxOpenConns(1)
+
+	return &SQLiteDB{db: db, trends: newTrendTracker(DefaultTrendingWindows)}, nil
+}
+
+// loadTrends recounts the trends over windows from the tagged chirps. It
+// needs the migrated schema, so Open runs it rather than NewSQLiteDB.
+func (sdb *SQLiteDB) loadTrends(windows []time.Duration) error {
+	rows, err := sdb.db.Query("SELECT " + chirpColumns + " FROM chirps WHERE id IN (SELECT chirp_id FROM chirp_hashtags) AND " + visibleChirps)
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not load trends")
+	}
+	defer rows.Close()
+
+	trends := newTrendTracker(windows)
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			log.Println(err)
+			return errors.New("could not load trends")
+		}
+		trends.addChirp(chirp)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return errors.New("could not load trends")
+	}
+
+	sdb.trends = trends
+	return nil
+}
+
+func (sdb *SQLiteDB) Trending(query TrendingQuery) ([]TrendingTag, error) {
+	return sdb.trends.top(query, time.Now())
+}
+
+func (sdb *SQLiteDB) Close() error {
+	return sdb.db.Close()
+}
+
+func (sdb *SQLiteDB) ListChirps(chirpQuery ChirpQuery) (ChirpPage, error) {
+	c, err := chirpQuery.decodeCursor()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	query := "SELECT " + chirpColumns + " FROM chirps WHERE " + visibleChirps
+	args := []any{}
+
+	if chirpQuery.AuthorID != 0 {
+		query += " AND author_id = ?"
+		args = append(args, chirpQuery.AuthorID)
+	}
+	if chirpQuery.InReplyTo != 0 {
+		query += " AND in_reply_to = ?"
+		args = append(args, chirpQuery.InReplyTo)
+	}
+	if chirpQuery.Hashtag != "" {
+		query += " AND id IN (SELECT chirp_id FROM chirp_hashtags WHERE tag = ?)"
+		args = append(args, HashtagKey(chirpQuery.Hashtag))
+	}
+	if chirpQuery.Mentions != 0 {
+		query += " AND id IN (SELECT chirp_id FROM chirp_mentions WHERE user_id = ?)"
+		args = append(args, chirpQuery.Mentions)
+	}
+	if chirpQuery.AfterID != 0 {
+		query += " AND id > ?"
+		args = append(args, chirpQuery.AfterID)
+	}
+	if chirpQuery.BeforeID != 0 {
+		query += " AND id < ?"
+		args = append(args, chirpQuery.BeforeID)
+	}
+
+	direction, comparison := "ASC", ">"
+	if chirpQuery.SortDesc {
+		direction, comparison = "DESC", "<"
+	}
+
+	if chirpQuery.SortBy == SortByCreatedAt {
+		if c != nil {
+			query += " AND (created_at, id) " + comparison + " (?, ?)"
+			args = append(args, c.CreatedAt, c.ID)
+		}
+		query += " ORDER BY created_at " + direction + ", id " + direction
+	} else {
+		if c != nil {
+			query += " AND id " + comparison + " ?"
+			args = append(args, c.ID)
+		}
+		query += " ORDER BY id " + direction
+	}
+
+	// Fetch one extra row to tell whether there is another page
+	if chirpQuery.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, chirpQuery.Limit+1)
+	}
+
+	rows, err := sdb.db.Query(query, args...)
+	if err != nil {
+		log.Println(err)
+		return ChirpPage{}, errors.New("could not read database")
+	}
+	defer rows.Close()
+
+	chirpList := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			log.Println(err)
+			return ChirpPage{}, errors.New("could not read database")
+		}
+
+		chirpList = append(chirpList, chirp)
+	}
+
+	if err = rows.Err(); err != nil {
+		return ChirpPage{}, err
+	}
+
+	page := ChirpPage{Chirps: chirpList}
+	if chirpQuery.Limit > 0 && len(chirpList) > chirpQuery.Limit {
+		page.Chirps = chirpList[:chirpQuery.Limit]
+		page.NextCursor = newCursor(chirpQuery, page.Chirps[chirpQuery.Limit-1])
+	}
+
+	return page, nil
+}
+
+func (sdb *SQLiteDB) SearchChirps(searchQuery SearchQuery) (ChirpPage, error) {
+	clauses, err := parseSearch(searchQuery.Query)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	c, err := searchQuery.decodeCursor()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	// bm25 ranks better matches lower, flip it so scores match the DB's
+	query := "SELECT " + chirpColumns + ", score FROM (" +
+		"SELECT rowid AS chirp_id, -bm25(chirps_fts) AS score FROM chirps_fts WHERE chirps_fts MATCH ?" +
+		") JOIN chirps ON id = chirp_id WHERE " + visibleChirps
+	args := []any{ftsMatch(clauses)}
+
+	if searchQuery.AuthorID != 0 {
+		query += " AND author_id = ?"
+		args = append(args, searchQuery.AuthorID)
+	}
+	if c != nil {
+		query += " AND (score, id) < (?, ?)"
+		args = append(args, c.Score, c.ID)
+	}
+	query += " ORDER BY score DESC, id DESC"
+
+	if searchQuery.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, searchQuery.Limit+1)
+	}
+
+	rows, err := sdb.db.Query(query, args...)
+	if err != nil {
+		log.Println(err)
+		return ChirpPage{}, errors.New("could not read database")
+	}
+	defer rows.Close()
+
+	page := ChirpPage{Chirps: []Chirp{}}
+	scores := []float64{}
+	for rows.Next() {
+		score := 0.0
+		chirp, err := scanChirp(trailing{rows, []any{&score}})
+		if err != nil {
+			log.Println(err)
+			return ChirpPage{}, errors.New("could not read database")
+		}
+
+		page.Chirps = append(page.Chirps, chirp)
+		scores = append(scores, score)
+	}
+
+	if err = rows.Err(); err != nil {
+		return ChirpPage{}, err
+	}
+
+	if searchQuery.Limit > 0 && len(page.Chirps) > searchQuery.Limit {
+		page.Chirps = page.Chirps[:searchQuery.Limit]
+		last := searchQuery.Limit - 1
+		page.NextCursor = searchQuery.nextCursor(scores[last], page.Chirps[last].ID)
+	}
+
+	return page, nil
+}
+
+func (sdb *SQLiteDB) ReadChirp(chirpID int) (Chirp, error) {
+	chirp, err := scanChirp(sdb.db.QueryRow(
+		"SELECT "+chirpColumns+" FROM chirps WHERE id = ? AND "+visibleChirps, chirpID,
+	))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, nil
+	}
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not read database")
+	}
+
+	return chirp, nil
+}
+
+func (sdb *SQLiteDB) CreateChirp(authorID int, body string) (Chirp, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+	defer tx.Rollback()
+
+	chirp := Chirp{
+		AuthorID: authorID,
+		Body:     body,
+	}
+
+	err = sdb.insertChirpTx(tx, &chirp)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+
+	sdb.trends.addChirp(chirp)
+
+	return chirp, nil
+}
+
+func (sdb *SQLiteDB) CreateReply(authorID int, inReplyTo int, body string) (Chirp, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+	defer tx.Rollback()
+
+	parent, err := visibleChirpTx(tx, inReplyTo)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirp := Chirp{
+		AuthorID:  authorID,
+		Body:      body,
+		InReplyTo: parent.ID,
+		RootID:    parent.root(),
+	}
+
+	err = sdb.insertChirpTx(tx, &chirp)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+
+	sdb.trends.addChirp(chirp)
+
+	return chirp, nil
+}
+
+func (sdb *SQLiteDB) CreateQuote(authorID int, quoteOf int, body string) (Chirp, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+	defer tx.Rollback()
+
+	original, err := visibleOriginalTx(tx, quoteOf)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirp := Chirp{
+		AuthorID: authorID,
+		Body:     body,
+		QuoteOf:  original.ID,
+	}
+
+	err = sdb.insertChirpTx(tx, &chirp)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+
+	_, err = tx.Exec("UPDATE chirps SET quote_count = quote_count + 1 WHERE id = ?", original.ID)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+
+	sdb.trends.addChirp(chirp)
+
+	return chirp, nil
+}
+
+func (sdb *SQLiteDB) Rechirp(userID int, chirpID int) (Chirp, bool, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, false, errors.New("could not save the rechirp")
+	}
+	defer tx.Rollback()
+
+	original, err := visibleOriginalTx(tx, chirpID)
+	if err != nil {
+		return Chirp{}, false, err
+	}
+
+	rechirp, err := scanChirp(tx.QueryRow(
+		"SELECT "+chirpColumns+" FROM chirps WHERE rechirp_of = ? AND author_id = ?", original.ID, userID,
+	))
+	if err == nil {
+		return rechirp, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Println(err)
+		return Chirp{}, false, errors.New("could not read database")
+	}
+
+	rechirp = Chirp{
+		AuthorID:  userID,
+		RechirpOf: original.ID,
+	}
+
+	err = sdb.insertChirpTx(tx, &rechirp)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, false, errors.New("could not save the rechirp")
+	}
+
+	_, err = tx.Exec("UPDATE chirps SET rechirp_count = rechirp_count + 1 WHERE id = ?", original.ID)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, false, errors.New("could not save the rechirp")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, false, errors.New("could not save the rechirp")
+	}
+
+	return rechirp, true, nil
+}
+
+func (sdb *SQLiteDB) Unrechirp(userID int, chirpID int) (Chirp, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not remove the rechirp")
+	}
+	defer tx.Rollback()
+
+	rechirp, err := scanChirp(tx.QueryRow(
+		"SELECT "+chirpColumns+" FROM chirps WHERE rechirp_of = ? AND author_id = ?", chirpID, userID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not read database")
+	}
+
+	_, err = tx.Exec("DELETE FROM chirps WHERE id = ?", rechirp.ID)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not remove the rechirp")
+	}
+
+	err = uncountTx(tx, rechirp)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not remove the rechirp")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not remove the rechirp")
+	}
+
+	return rechirp, nil
+}
+
+func (sdb *SQLiteDB) UpdateChirp(authorID int, chirpID int, body string) (Chirp, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+	defer tx.Rollback()
+
+	chirp, err := readChirpTx(tx, chirpID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.AuthorID != authorID {
+		return Chirp{}, ErrNotAuthor
+	}
+	if chirp.RechirpOf != 0 {
+		return Chirp{}, ErrRechirp
+	}
+	if chirp.Body == body {
+		return chirp, nil
+	}
+
+	_, err = sdb.insertTx(
+		tx, "chirp_revisions", []string{"chirp_id", "body", "created_at"},
+		chirp.ID, chirp.Body, chirp.UpdatedAt,
+	)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+
+	old := chirp
+	chirp.Body = body
+	chirp.Entities = entitiesTx(tx, body)
+	chirp.Edited = true
+	chirp.UpdatedAt = time.Now().UTC()
+
+	entities, _ := json.Marshal(chirp.Entities)
+	_, err = tx.Exec(
+		"UPDATE chirps SET body = ?, entities = ?, edited = 1, updated_at = ? WHERE id = ?",
+		chirp.Body, string(entities), chirp.UpdatedAt, chirp.ID,
+	)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+
+	err = saveEntitiesTx(tx, chirp)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the chirp")
+	}
+
+	sdb.trends.removeChirp(old)
+	sdb.trends.addChirp(chirp)
+
+	return chirp, nil
+}
+
+func (sdb *SQLiteDB) DeleteChirp(authorID int, chirpID int) (Chirp, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not delete the chirp")
+	}
+	defer tx.Rollback()
+
+	chirp, err := readChirpTx(tx, chirpID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.AuthorID != authorID {
+		return Chirp{}, ErrNotAuthor
+	}
+
+	// Revisions are removed by ON DELETE CASCADE. Rechirps go with the
+	// chirp too, quotes stay as they have a body of their own
+	_, err = tx.Exec("DELETE FROM chirps WHERE id = ? OR rechirp_of = ?", chirpID, chirpID)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not delete the chirp")
+	}
+
+	err = uncountTx(tx, chirp)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not delete the chirp")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not delete the chirp")
+	}
+
+	sdb.trends.removeChirp(chirp)
+
+	return chirp, nil
+}
+
+func (sdb *SQLiteDB) ListRevisions(chirpID int) ([]Revision, error) {
+	chirp, err := sdb.ReadChirp(chirpID)
+	if err != nil {
+		return nil, err
+	}
+	if chirp.ID == 0 {
+		return nil, ErrChirpNotFound
+	}
+
+	rows, err := sdb.db.Query(
+		"SELECT id, chirp_id, body, created_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY id",
+		chirpID,
+	)
+	if err != nil {
+		log.Println(err)
+		return nil, errors.New("could not read database")
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		revision := Revision{}
+		err = rows.Scan(&revision.ID, &revision.ChirpID, &revision.Body, &revision.CreatedAt)
+		if err != nil {
+			log.Println(err)
+			return nil, errors.New("could not read database")
+		}
+
+		revision.CreatedAt = revision.CreatedAt.UTC()
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (sdb *SQLiteDB) LikeChirp(userID int, chirpID int) (Chirp, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the like")
+	}
+	defer tx.Rollback()
+
+	chirp, err := visibleOriginalTx(tx, chirpID)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	likeID := 0
+	err = tx.QueryRow("SELECT id FROM likes WHERE user_id = ? AND chirp_id = ?", userID, chirp.ID).Scan(&likeID)
+	if err == nil {
+		return chirp, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Println(err)
+		return Chirp{}, errors.New("could not read database")
+	}
+
+	_, err = sdb.insertTx(
+		tx, "likes", []string{"user_id", "chirp_id", "created_at"},
+		userID, chirp.ID, time.Now().UTC(),
+	)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the like")
+	}
+
+	_, err = tx.Exec("UPDATE chirps SET like_count = like_count + 1 WHERE id = ?", chirp.ID)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the like")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not save the like")
+	}
+
+	chirp.LikeCount++
+	return chirp, nil
+}
+
+func (sdb *SQLiteDB) UnlikeChirp(userID int, chirpID int) (Chirp, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not remove the like")
+	}
+	defer tx.Rollback()
+
+	chirp, err := originalTx(tx, chirpID)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	result, err := tx.Exec("DELETE FROM likes WHERE user_id = ? AND chirp_id = ?", userID, chirp.ID)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not remove the like")
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return chirp, nil
+	}
+
+	_, err = tx.Exec("UPDATE chirps SET like_count = like_count - 1 WHERE id = ?", chirp.ID)
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not remove the like")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not remove the like")
+	}
+
+	chirp.LikeCount--
+	return chirp, nil
+}
+
+func (sdb *SQLiteDB) LikedChirps(userID int, chirpIDs []int) (map[int]bool, error) {
+	liked := map[int]bool{}
+	if len(chirpIDs) == 0 {
+		return liked, nil
+	}
+
+	args := []any{userID}
+	for _, id := range chirpIDs {
+		args = append(args, id)
+	}
+
+	rows, err := sdb.db.Query(
+		"SELECT chirp_id FROM likes WHERE user_id = ? AND chirp_id IN (?"+strings.Repeat(", ?", len(chirpIDs)-1)+")",
+		args...,
+	)
+	if err != nil {
+		log.Println(err)
+		return nil, errors.New("could not read database")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		chirpID := 0
+		err = rows.Scan(&chirpID)
+		if err != nil {
+			log.Println(err)
+			return nil, errors.New("could not read database")
+		}
+		liked[chirpID] = true
+	}
+
+	return liked, rows.Err()
+}
+
+func (sdb *SQLiteDB) ListLikes(likeQuery LikeQuery) (ChirpPage, error) {
+	c, err := likeQuery.decodeCursor()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	likes := "SELECT id AS like_id, chirp_id FROM likes WHERE user_id = ? AND chirp_id IN (SELECT id FROM chirps WHERE " + visibleChirps + ")"
+	args := []any{likeQuery.UserID}
+
+	if c != nil {
+		likes += " AND id < ?"
+		args = append(args, c.LikeID)
+	}
+	likes += " ORDER BY id DESC"
+
+	if likeQuery.Limit > 0 {
+		likes += " LIMIT ?"
+		args = append(args, likeQuery.Limit+1)
+	}
+
+	rows, err := sdb.db.Query(
+		"SELECT "+chirpColumns+", like_id FROM ("+likes+") JOIN chirps ON id = chirp_id ORDER BY like_id DESC",
+		args...,
+	)
+	if err != nil {
+		log.Println(err)
+		return ChirpPage{}, errors.New("could not read database")
+	}
+	defer rows.Close()
+
+	page := ChirpPage{Chirps: []Chirp{}}
+	likeIDs := []int{}
+	for rows.Next() {
+		likeID := 0
+		chirp, err := scanChirp(trailing{rows, []any{&likeID}})
+		if err != nil {
+			log.Println(err)
+			return ChirpPage{}, errors.New("could not read database")
+		}
+
+		page.Chirps = append(page.Chirps, chirp)
+		likeIDs = append(likeIDs, likeID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return ChirpPage{}, err
+	}
+
+	if likeQuery.Limit > 0 && len(page.Chirps) > likeQuery.Limit {
+		page.Chirps = page.Chirps[:likeQuery.Limit]
+		page.NextCursor = likeQuery.nextCursor(likeIDs[likeQuery.Limit-1])
+	}
+
+	return page, nil
+}
+
+func (sdb *SQLiteDB) Follow(followerID int, followeeID int) error {
+	if followerID == followeeID {
+		return ErrFollowSelf
+	}
+
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not save the follow")
+	}
+	defer tx.Rollback()
+
+	_, err = scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ? AND deleted_at IS NULL", followeeID))
+	if err != nil {
+		return err
+	}
+
+	followID := 0
+	err = tx.QueryRow(
+		"SELECT id FROM follows WHERE follower_id = ? AND followee_id = ?", followerID, followeeID,
+	).Scan(&followID)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Println(err)
+		return errors.New("could not read database")
+	}
+
+	_, err = sdb.insertTx(
+		tx, "follows", []string{"follower_id", "followee_id", "created_at"},
+		followerID, followeeID, time.Now().UTC(),
+	)
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not save the follow")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not save the follow")
+	}
+
+	return nil
+}
+
+func (sdb *SQLiteDB) Unfollow(followerID int, followeeID int) error {
+	_, err := sdb.db.Exec(
+		"DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", followerID, followeeID,
+	)
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not remove the follow")
+	}
+
+	return nil
+}
+
+func (sdb *SQLiteDB) ListFollowers(query FollowQuery) (UserPage, error) {
+	return sdb.listFollows(query, "followers")
+}
+
+func (sdb *SQLiteDB) ListFollowing(query FollowQuery) (UserPage, error) {
+	return sdb.listFollows(query, "following")
+}
+
+func (sdb *SQLiteDB) listFollows(followQuery FollowQuery, list string) (UserPage, error) {
+	c, err := followQuery.decodeCursor(list)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	follows := "SELECT id AS follow_id, followee_id AS user_ref FROM follows WHERE follower_id = ?"
+	if list == "followers" {
+		follows = "SELECT id AS follow_id, follower_id AS user_ref FROM follows WHERE followee_id = ?"
+	}
+	follows += " AND user_ref NOT IN (SELECT id FROM users WHERE deleted_at IS NOT NULL)"
+	args := []any{followQuery.UserID}
+
+	if c != nil {
+		follows += " AND id < ?"
+		args = append(args, c.FollowID)
+	}
+	follows += " ORDER BY id DESC"
+
+	if followQuery.Limit > 0 {
+		follows += " LIMIT ?"
+		args = append(args, followQuery.Limit+1)
+	}
+
+	rows, err := sdb.db.Query(
+		"SELECT "+userColumns+", follow_id FROM ("+follows+") JOIN users ON id = user_ref ORDER BY follow_id DESC",
+		args...,
+	)
+	if err != nil {
+		log.Println(err)
+		return UserPage{}, errors.New("could not read database")
+	}
+	defer rows.Close()
+
+	page := UserPage{Users: []User{}}
+	followIDs := []int{}
+	for rows.Next() {
+		followID := 0
+		user, err := scanUser(trailing{rows, []any{&followID}})
+		if err != nil {
+			return UserPage{}, err
+		}
+
+		user.Password = ""
+		page.Users = append(page.Users, user)
+		followIDs = append(followIDs, followID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return UserPage{}, err
+	}
+
+	if followQuery.Limit > 0 && len(page.Users) > followQuery.Limit {
+		page.Users = page.Users[:followQuery.Limit]
+		page.NextCursor = followQuery.nextCursor(list, followIDs[followQuery.Limit-1])
+	}
+
+	return page, nil
+}
+
+func (sdb *SQLiteDB) Timeline(timelineQuery TimelineQuery) (ChirpPage, error) {
+	c, err := timelineQuery.decodeCursor()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	query := "SELECT " + chirpColumns + " FROM chirps WHERE author_id IN (SELECT followee_id FROM follows WHERE follower_id = ?) AND " + visibleChirps
+	args := []any{timelineQuery.UserID}
+
+	if c != nil {
+		query += " AND id < ?"
+		args = append(args, c.ID)
+	}
+	query += " ORDER BY id DESC"
+
+	if timelineQuery.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, timelineQuery.Limit+1)
+	}
+
+	rows, err := sdb.db.Query(query, args...)
+	if err != nil {
+		log.Println(err)
+		return ChirpPage{}, errors.New("could not read database")
+	}
+	defer rows.Close()
+
+	page := ChirpPage{Chirps: []Chirp{}}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			log.Println(err)
+			return ChirpPage{}, errors.New("could not read database")
+		}
+
+		page.Chirps = append(page.Chirps, chirp)
+	}
+
+	if err = rows.Err(); err != nil {
+		return ChirpPage{}, err
+	}
+
+	if timelineQuery.Limit > 0 && len(page.Chirps) > timelineQuery.Limit {
+		page.Chirps = page.Chirps[:timelineQuery.Limit]
+		page.NextCursor = timelineQuery.nextCursor(page.Chirps[timelineQuery.Limit-1].ID)
+	}
+
+	return page, nil
+}
+
+func (sdb *SQLiteDB) CreateUser(email string, password string) (User, error) {
+	_, err := sdb.findUserByEmail(email)
+	if err == nil {
+		return User{}, errors.New("user email already exists")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+	if err != nil {
+		return User{}, errors.New("problem saving password")
+	}
+
+	now := time.Now().UTC()
+	id, err := sdb.insert(
+		"users", []string{"email", "password", "created_at", "updated_at"},
+		email, string(hash), now, now,
+	)
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not save the user")
+	}
+
+	return User{
+		ID:          id,
+		Email:       email,
+		IsChirpyRed: false,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}, nil
+}
+
+func (sdb *SQLiteDB) UpdateUser(userId int, email string, password string) (User, error) {
+	user, err := sdb.findUserById(userId)
+	if err != nil {
+		return User{}, ErrUserNotFound
+	}
+
+	existing, err := sdb.findUserByEmail(email)
+	if err == nil && existing.ID != user.ID {
+		return User{}, errors.New("user email already exists")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+	if err != nil {
+		return User{}, errors.New("problem saving password")
+	}
+
+	now := time.Now().UTC()
+	_, err = sdb.db.Exec(
+		"UPDATE users SET email = ?, password = ?, updated_at = ? WHERE id = ?",
+		email, string(hash), now, userId,
+	)
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not save the user")
+	}
+
+	user.Email = email
+	user.UpdatedAt = now
+	user.Password = ""
+	return user, nil
+}
+
+func (sdb *SQLiteDB) ReadUser(userID int) (User, error) {
+	user, err := sdb.findUserById(userID)
+	if err != nil {
+		return User{}, err
+	}
+
+	user.Password = ""
+	return user, nil
+}
+
+func (sdb *SQLiteDB) ReadUserByHandle(handle string) (User, error) {
+	user, err := sdb.findUserByHandle(handle)
+	if err != nil {
+		return User{}, err
+	}
+
+	user.Password = ""
+	return user, nil
+}
+
+func (sdb *SQLiteDB) ReadUsers(userIDs []int) (map[int]User, error) {
+	users := map[int]User{}
+	if len(userIDs) == 0 {
+		return users, nil
+	}
+
+	args := []any{}
+	for _, id := range userIDs {
+		args = append(args, id)
+	}
+
+	rows, err := sdb.db.Query(
+		"SELECT "+userColumns+" FROM users WHERE id IN (?"+strings.Repeat(", ?", len(userIDs)-1)+")",
+		args...,
+	)
+	if err != nil {
+		log.Println(err)
+		return nil, errors.New("could not read database")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		user.Password = ""
+		users[user.ID] = user
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, errors.New("could not read database")
+	}
+
+	return users, nil
+}
+
+func (sdb *SQLiteDB) UpdateProfile(userID int, update ProfileUpdate) (User, error) {
+	user, err := sdb.findUserById(userID)
+	if err != nil {
+		return User{}, ErrUserNotFound
+	}
+
+	user = update.apply(user)
+	if user.Handle != "" {
+		existing, err := sdb.findUserByHandle(user.Handle)
+		if err == nil && existing.ID != user.ID {
+			return User{}, ErrHandleTaken
+		}
+	}
+	user.UpdatedAt = time.Now().UTC()
+
+	_, err = sdb.db.Exec(
+		"UPDATE users SET handle = ?, display_name = ?, bio = ?, avatar_url = ?, updated_at = ? WHERE id = ?",
+		user.Handle, user.DisplayName, user.Bio, user.AvatarURL, user.UpdatedAt, user.ID,
+	)
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not save the user")
+	}
+
+	user.Password = ""
+	return user, nil
+}
+
+func (sdb *SQLiteDB) DeleteUser(userID int) (User, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not delete the user")
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userID))
+	if err != nil {
+		return User{}, err
+	}
+	user.Password = ""
+	if user.DeletedAt != nil {
+		return user, nil
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.Exec("UPDATE users SET deleted_at = ?, updated_at = ? WHERE id = ?", now, now, user.ID)
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not delete the user")
+	}
+
+	err = endSessionsTx(tx, user.ID)
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not delete the user")
+	}
+
+	chirps, err := taggedChirpsTx(tx, user.ID)
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not delete the user")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not delete the user")
+	}
+
+	for _, chirp := range chirps {
+		sdb.trends.removeChirp(chirp)
+	}
+
+	user.DeletedAt = &now
+	user.UpdatedAt = now
+	return user, nil
+}
+
+func (sdb *SQLiteDB) RestoreUser(email string, password string) (User, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not restore the user")
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE email = ? COLLATE NOCASE", email))
+	if err != nil {
+		return User{}, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		return User{}, errors.New("incorrect credentials")
+	}
+	user.Password = ""
+	if user.DeletedAt == nil {
+		return user, nil
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.Exec("UPDATE users SET deleted_at = NULL, updated_at = ? WHERE id = ?", now, user.ID)
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not restore the user")
+	}
+
+	chirps, err := taggedChirpsTx(tx, user.ID)
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not restore the user")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not restore the user")
+	}
+
+	for _, chirp := range chirps {
+		sdb.trends.addChirp(chirp)
+	}
+
+	user.DeletedAt = nil
+	user.UpdatedAt = now
+	return user, nil
+}
+
+// taggedChirpsTx returns the chirps by authorID that count towards trends.
+func taggedChirpsTx(tx *sql.Tx, authorID int) ([]Chirp, error) {
+	rows, err := tx.Query(
+		"SELECT "+chirpColumns+" FROM chirps WHERE author_id = ? AND id IN (SELECT chirp_id FROM chirp_hashtags)", authorID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, rows.Err()
+}
+
+func (sdb *SQLiteDB) PurgeDeletedUsers(before time.Time) (int, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return 0, errors.New("could not purge users")
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM users WHERE deleted_at < ?", before.UTC())
+	if err != nil {
+		log.Println(err)
+		return 0, errors.New("could not purge users")
+	}
+	userIDs := []int{}
+	for rows.Next() {
+		id := 0
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			log.Println(err)
+			return 0, errors.New("could not purge users")
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+
+	for _, userID := range userIDs {
+		err = purgeUserTx(tx, userID)
+		if err != nil {
+			log.Println(err)
+			return 0, errors.New("could not purge users")
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return 0, errors.New("could not purge users")
+	}
+
+	return len(userIDs), nil
+}
+
+// purgeUserTx removes userID and everything that belongs to them. Revisions,
+// likes of their chirps, entities and follows go by ON DELETE CASCADE.
+// Replies and quotes by others stay, as with DeleteChirp.
+func purgeUserTx(tx *sql.Tx, userID int) error {
+	// Their rechirps and quotes come off the counts of other chirps
+	statements := []string{
+		"UPDATE chirps SET rechirp_count = rechirp_count - 1 WHERE id IN (SELECT rechirp_of FROM chirps WHERE author_id = ?1)",
+		"UPDATE chirps SET quote_count = quote_count - (SELECT COUNT(*) FROM chirps AS quotes WHERE quotes.quote_of = chirps.id AND quotes.author_id = ?1) " +
+			"WHERE id IN (SELECT quote_of FROM chirps WHERE author_id = ?1)",
+		"UPDATE chirps SET like_count = like_count - 1 WHERE id IN (SELECT chirp_id FROM likes WHERE user_id = ?1)",
+		"DELETE FROM likes WHERE user_id = ?1",
+		"DELETE FROM chirps WHERE rechirp_of IN (SELECT id FROM chirps WHERE author_id = ?1)",
+		"DELETE FROM chirps WHERE author_id = ?1",
+		"DELETE FROM refresh_tokens WHERE user_id = ?1",
+		"DELETE FROM sessions WHERE user_id = ?1",
+		"DELETE FROM users WHERE id = ?1",
+	}
+	for _, statement := range statements {
+		_, err := tx.Exec(statement, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sdb *SQLiteDB) ActivateChirpyRed(userId int) error {
+	result, err := sdb.db.Exec(
+		"UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ?", time.Now().UTC(), userId,
+	)
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not save the user")
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+func (sdb *SQLiteDB) Login(email string, password string) (User, error) {
+	user, err := sdb.findUserByEmail(email)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		return User{}, errors.New("incorrect credentials")
+	}
+
+	user.Password = ""
+	return user, nil
+}
+
+func (sdb *SQLiteDB) SaveRefreshToken(userID int, token string, device Device, expiresAt time.Time) (Session, error) {
+	family, err := newTokenFamily()
+	if err != nil {
+		return Session{}, err
+	}
+
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return Session{}, errors.New("could not save the refresh token")
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	session := Session{ID: family, UserID: userID, CreatedAt: now}.use(device, now, expiresAt)
+	err = saveSessionTx(tx, session)
+	if err != nil {
+		log.Println(err)
+		return Session{}, errors.New("could not save the refresh token")
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO refresh_tokens (token, user_id, family, revoked, rotated, expires_at) VALUES (?, ?, ?, 0, 0, ?) "+
+			"ON CONFLICT (token) DO UPDATE SET user_id = excluded.user_id, family = excluded.family, revoked = 0, rotated = 0, expires_at = excluded.expires_at",
+		token, userID, family, session.ExpiresAt,
+	)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return Session{}, errors.New("could not save the refresh token")
+	}
+
+	return session, nil
+}
+
+func (sdb *SQLiteDB) CheckRefreshToken(token string) bool {
+	revoked, rotated := false, false
+	err := sdb.db.QueryRow(
+		"SELECT revoked, rotated FROM refresh_tokens WHERE token = ? AND expires_at > ?", token, time.Now().UTC(),
+	).Scan(&revoked, &rotated)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println(err)
+		}
+		return false
+	}
+
+	return !revoked && !rotated
+}
+
+func (sdb *SQLiteDB) RotateRefreshToken(token string, next string, device Device, expiresAt time.Time) (RefreshToken, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return RefreshToken{}, errors.New("could not rotate the refresh token")
+	}
+	defer tx.Rollback()
+
+	refreshToken := RefreshToken{}
+	err = tx.QueryRow(
+		"SELECT user_id, family, revoked, rotated, expires_at FROM refresh_tokens WHERE token = ?", token,
+	).Scan(&refreshToken.UserID, &refreshToken.Family, &refreshToken.Revoked, &refreshToken.Rotated, &refreshToken.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		log.Println(err)
+		return RefreshToken{}, errors.New("could not rotate the refresh token")
+	}
+
+	if refreshToken.Rotated {
+		err = endSessionTx(tx, refreshToken.UserID, refreshToken.Family)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Println(err)
+			return RefreshToken{}, errors.New("could not revoke the refresh token family")
+		}
+		return refreshToken, ErrRefreshTokenReused
+	}
+	if refreshToken.Revoked || refreshToken.expired(time.Now()) {
+		return RefreshToken{}, ErrInvalidRefreshToken
+	}
+
+	if refreshToken.Family == "" {
+		refreshToken.Family, err = newTokenFamily()
+		if err != nil {
+			return RefreshToken{}, err
+		}
+	}
+
+	_, err = tx.Exec(
+		"UPDATE refresh_tokens SET family = ?, rotated = 1 WHERE token = ?",
+		refreshToken.Family, token,
+	)
+	if err != nil {
+		log.Println(err)
+		return RefreshToken{}, errors.New("could not rotate the refresh token")
+	}
+
+	nextToken := RefreshToken{UserID: refreshToken.UserID, Family: refreshToken.Family, ExpiresAt: expiresAt.UTC()}
+	_, err = tx.Exec(
+		"INSERT INTO refresh_tokens (token, user_id, family, revoked, rotated, expires_at) VALUES (?, ?, ?, 0, 0, ?)",
+		next, nextToken.UserID, nextToken.Family, nextToken.ExpiresAt,
+	)
+	if err != nil {
+		log.Println(err)
+		return RefreshToken{}, errors.New("could not rotate the refresh token")
+	}
+
+	// Tokens from before sessions were recorded start one here
+	now := time.Now().UTC()
+	session, err := scanSession(tx.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", nextToken.Family))
+	if errors.Is(err, sql.ErrNoRows) {
+		session, err = Session{ID: nextToken.Family, UserID: nextToken.UserID, CreatedAt: now}, nil
+	}
+	if err == nil {
+		err = saveSessionTx(tx, session.use(device, now, expiresAt))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return RefreshToken{}, errors.New("could not rotate the refresh token")
+	}
+
+	return nextToken, nil
+}
+
+func (sdb *SQLiteDB) RevokeRefreshToken(token string) error {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not revoke the refresh token")
+	}
+	defer tx.Rollback()
+
+	userID, family := 0, ""
+	err = tx.QueryRow(
+		"UPDATE refresh_tokens SET revoked = 1 WHERE token = ? RETURNING user_id, family", token,
+	).Scan(&userID, &family)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err == nil && family != "" {
+		err = endSessionTx(tx, userID, family)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not revoke the refresh token")
+	}
+
+	return nil
+}
+
+func (sdb *SQLiteDB) PurgeExpiredTokens(now time.Time) (int, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return 0, errors.New("could not purge refresh tokens")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM refresh_tokens WHERE revoked = 1 OR expires_at <= ?", now.UTC())
+	if err != nil {
+		log.Println(err)
+		return 0, errors.New("could not purge refresh tokens")
+	}
+	purged, err := result.RowsAffected()
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM sessions WHERE expires_at <= ?", now.UTC())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return 0, errors.New("could not purge refresh tokens")
+	}
+
+	return int(purged), nil
+}
+
+func (sdb *SQLiteDB) ListSessions(userID int) ([]Session, error) {
+	rows, err := sdb.db.Query(
+		"SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY last_used_at DESC, id",
+		userID, time.Now().UTC(),
+	)
+	if err != nil {
+		log.Println(err)
+		return nil, errors.New("could not list sessions")
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, errors.New("could not list sessions")
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (sdb *SQLiteDB) CountLiveSessions() (int, error) {
+	live := 0
+	err := sdb.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE expires_at > ?", time.Now().UTC()).Scan(&live)
+	if err != nil {
+		log.Println(err)
+		return 0, errors.New("could not count sessions")
+	}
+
+	return live, nil
+}
+
+func (sdb *SQLiteDB) RevokeSession(userID int, sessionID string) error {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not revoke the session")
+	}
+	defer tx.Rollback()
+
+	exists := false
+	err = tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM sessions WHERE id = ? AND user_id = ?)", sessionID, userID,
+	).Scan(&exists)
+	if err == nil && !exists {
+		return ErrSessionNotFound
+	}
+	if err == nil {
+		err = endSessionTx(tx, userID, sessionID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not revoke the session")
+	}
+
+	return nil
+}
+
+func (sdb *SQLiteDB) RevokeSessions(userID int) error {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not revoke the sessions")
+	}
+	defer tx.Rollback()
+
+	err = endSessionsTx(tx, userID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not revoke the sessions")
+	}
+
+	return nil
+}
+
+func saveSessionTx(tx *sql.Tx, session Session) error {
+	_, err := tx.Exec(
+		"INSERT INTO sessions ("+sessionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?) "+
+			"ON CONFLICT (id) DO UPDATE SET device_name = excluded.device_name, user_agent = excluded.user_agent, ip = excluded.ip, "+
+			"last_used_at = excluded.last_used_at, expires_at = excluded.expires_at",
+		session.ID, session.UserID, session.DeviceName, session.UserAgent, session.IP, session.CreatedAt, session.LastUsedAt, session.ExpiresAt,
+	)
+	return err
+}
+
+// endSessionTx revokes the refresh tokens in the family of session id and
+// removes the session.
+func endSessionTx(tx *sql.Tx, userID int, id string) error {
+	_, err := tx.Exec("UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ? AND family = ?", userID, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// endSessionsTx logs userID out everywhere, including tokens issued before
+// sessions were recorded.
+func endSessionsTx(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec("UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// insert adds a row to table and returns its ID. AUTOINCREMENT already
+// keeps a persistent per-table sequence in sqlite_sequence, so snowflake IDs
+// are checked against it to stay monotonic too.
+func (sdb *SQLiteDB) insert(table string, columns []string, args ...any) (int, error) {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := sdb.insertTx(tx, table, columns, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// insertTx is insert as part of a larger transaction.
+func (sdb *SQLiteDB) insertTx(tx *sql.Tx, table string, columns []string, args ...any) (int, error) {
+	if sdb.ids == SnowflakeIDs {
+		last := 0
+		err := tx.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = ?", table).Scan(&last)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+
+		columns = append([]string{"id"}, columns...)
+		args = append([]any{nextID(sdb.ids, last)}, args...)
+	}
+
+	query := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (?" +
+		strings.Repeat(", ?", len(columns)-1) + ")"
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// insertChirpTx saves a new chirp, filling in its ID, entities and
+// timestamps.
+func (sdb *SQLiteDB) insertChirpTx(tx *sql.Tx, chirp *Chirp) error {
+	now := time.Now().UTC()
+	chirp.Entities = entitiesTx(tx, chirp.Body)
+	chirp.CreatedAt = now
+	chirp.UpdatedAt = now
+
+	entities, _ := json.Marshal(chirp.Entities)
+
+	id, err := sdb.insertTx(
+		tx, "chirps",
+		[]string{"author_id", "body", "entities", "in_reply_to", "root_id", "rechirp_of", "quote_of", "created_at", "updated_at"},
+		chirp.AuthorID, chirp.Body, string(entities), chirp.InReplyTo, chirp.RootID, chirp.RechirpOf, chirp.QuoteOf, now, now,
+	)
+	if err != nil {
+		return err
+	}
+	chirp.ID = id
+
+	return saveEntitiesTx(tx, *chirp)
+}
+
+// entitiesTx parses body and resolves its mentions against the users table.
+func entitiesTx(tx *sql.Tx, body string) []Entity {
+	return resolveMentions(parseEntities(body), func(name string) int {
+		// Handles are never all digits, so those are IDs
+		id, err := strconv.Atoi(name)
+		if err == nil {
+			err = tx.QueryRow("SELECT id FROM users WHERE id = ?", id).Scan(&id)
+		} else {
+			err = tx.QueryRow("SELECT id FROM users WHERE handle = ? COLLATE NOCASE", name).Scan(&id)
+		}
+		if err != nil {
+			return 0
+		}
+		return id
+	})
+}
+
+// saveEntitiesTx replaces the hashtag and mention index rows of chirp.
+func saveEntitiesTx(tx *sql.Tx, chirp Chirp) error {
+	_, err := tx.Exec("DELETE FROM chirp_hashtags WHERE chirp_id = ?", chirp.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM chirp_mentions WHERE chirp_id = ?", chirp.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range hashtags(chirp.Entities) {
+		_, err = tx.Exec("INSERT INTO chirp_hashtags (tag, chirp_id) VALUES (?, ?)", tag, chirp.ID)
+		if err != nil {
+			return err
+		}
+	}
+	for _, userID := range mentions(chirp.Entities) {
+		_, err = tx.Exec("INSERT INTO chirp_mentions (user_id, chirp_id) VALUES (?, ?)", userID, chirp.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readChirpTx(tx *sql.Tx, chirpID int) (Chirp, error) {
+	chirp, err := scanChirp(tx.QueryRow(
+		"SELECT "+chirpColumns+" FROM chirps WHERE id = ?", chirpID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not read database")
+	}
+
+	return chirp, nil
+}
+
+// visibleChirpTx reads chirpID unless it belongs to a deleted account, for
+// chirps that are being replied to or reposted.
+func visibleChirpTx(tx *sql.Tx, chirpID int) (Chirp, error) {
+	chirp, err := scanChirp(tx.QueryRow(
+		"SELECT "+chirpColumns+" FROM chirps WHERE id = ? AND "+visibleChirps, chirpID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		return Chirp{}, errors.New("could not read database")
+	}
+
+	return chirp, nil
+}
+
+// visibleOriginalTx is originalTx for chirps that are being liked or
+// reposted, neither chirp may belong to a deleted account.
+func visibleOriginalTx(tx *sql.Tx, chirpID int) (Chirp, error) {
+	chirp, err := visibleChirpTx(tx, chirpID)
+	if err != nil || chirp.RechirpOf == 0 {
+		return chirp, err
+	}
+
+	return visibleChirpTx(tx, chirp.RechirpOf)
+}
+
+// originalTx reads chirpID, or the chirp it reposts if it's a rechirp.
+func originalTx(tx *sql.Tx, chirpID int) (Chirp, error) {
+	chirp, err := readChirpTx(tx, chirpID)
+	if err != nil || chirp.RechirpOf == 0 {
+		return chirp, err
+	}
+
+	return readChirpTx(tx, chirp.RechirpOf)
+}
+
+// uncountTx takes a rechirp or quote that is going away off the counts of
+// the chirp it reposts.
+func uncountTx(tx *sql.Tx, chirp Chirp) error {
+	var err error
+	if chirp.RechirpOf != 0 {
+		_, err = tx.Exec("UPDATE chirps SET rechirp_count = rechirp_count - 1 WHERE id = ?", chirp.RechirpOf)
+	}
+	if chirp.QuoteOf != 0 {
+		_, err = tx.Exec("UPDATE chirps SET quote_count = quote_count - 1 WHERE id = ?", chirp.QuoteOf)
+	}
+
+	return err
+}
+
+// trailing reads extra columns selected after those of a row, such as a
+// relevance score.
+type trailing struct {
+	row   scanner
+	extra []any
+}
+
+func (t trailing) Scan(dest ...any) error {
+	return t.row.Scan(append(dest, t.extra...)...)
+}
+
+const chirpColumns = "id, author_id, body, entities, edited, in_reply_to, root_id, rechirp_of, quote_of, rechirp_count, quote_count, like_count, created_at, updated_at"
+
+func scanChirp(row scanner) (Chirp, error) {
+	chirp := Chirp{}
+	entities := ""
+	err := row.Scan(
+		&chirp.ID, &chirp.AuthorID, &chirp.Body, &entities, &chirp.Edited, &chirp.InReplyTo, &chirp.RootID,
+		&chirp.RechirpOf, &chirp.QuoteOf, &chirp.RechirpCount, &chirp.QuoteCount, &chirp.LikeCount, &chirp.CreatedAt, &chirp.UpdatedAt,
+	)
+	if err != nil {
+		return chirp, err
+	}
+
+	chirp.CreatedAt = chirp.CreatedAt.UTC()
+	chirp.UpdatedAt = chirp.UpdatedAt.UTC()
+
+	return chirp, json.Unmarshal([]byte(entities), &chirp.Entities)
+}
+
+const userColumns = "id, email, password, is_chirpy_red, handle, display_name, bio, avatar_url, created_at, updated_at, deleted_at"
+
+// visibleChirps filters out the chirps of deleted accounts. Authors don't
+// always have a users row, so it excludes rather than joins.
+const visibleChirps = "author_id NOT IN (SELECT id FROM users WHERE deleted_at IS NOT NULL)"
+
+func scanUser(row scanner) (User, error) {
+	user := User{}
+	deletedAt := sql.NullTime{}
+	err := row.Scan(
+		&user.ID, &user.Email, &user.Password, &user.IsChirpyRed,
+		&user.Handle, &user.DisplayName, &user.Bio, &user.AvatarURL,
+		&user.CreatedAt, &user.UpdatedAt, &deletedAt,
+	)
+	if deletedAt.Valid {
+		deleted := deletedAt.Time.UTC()
+		user.DeletedAt = &deleted
+	}
+	user.CreatedAt = user.CreatedAt.UTC()
+	user.UpdatedAt = user.UpdatedAt.UTC()
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		return User{}, errors.New("could not read database")
+	}
+
+	return user, nil
+}
+
+const sessionColumns = "id, user_id, device_name, user_agent, ip, created_at, last_used_at, expires_at"
+
+func scanSession(row scanner) (Session, error) {
+	session := Session{}
+	err := row.Scan(
+		&session.ID, &session.UserID, &session.DeviceName, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt,
+	)
+	if err != nil {
+		return Session{}, err
+	}
+
+	session.CreatedAt = session.CreatedAt.UTC()
+	session.LastUsedAt = session.LastUsedAt.UTC()
+	session.ExpiresAt = session.ExpiresAt.UTC()
+	return session, nil
+}
+
+func (sdb *SQLiteDB) findUserByEmail(email string) (User, error) {
+	return scanUser(sdb.db.QueryRow("SELECT "+userColumns+" FROM users WHERE email = ? COLLATE NOCASE", email))
+}
+
+func (sdb *SQLiteDB) findUserById(id int) (User, error) {
+	return scanUser(sdb.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+func (sdb *SQLiteDB) findUserByHandle(handle string) (User, error) {
+	return scanUser(sdb.db.QueryRow("SELECT "+userColumns+" FROM users WHERE handle = ? COLLATE NOCASE AND handle != ''", handleKey(handle)))
+}
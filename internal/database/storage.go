@@ -0,0 +1,169 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// compactAfterBytes is how large the write-ahead log may grow before it is
+// folded into a fresh snapshot.
+const compactAfterBytes = 256 << 10
+
+// storage persists the mutations made to a DB's in-memory Schema.
+type storage interface {
+	// load reads back the schema as last persisted.
+	load() (Schema, error)
+	// commit persists changes, which have already been applied to schema.
+	commit(schema Schema, changes []change) error
+	// close persists schema in full so no log needs replaying on startup.
+	close(schema Schema) error
+}
+
+// jsonStorage keeps the schema as a JSON snapshot on disk plus a write-ahead
+// log of the changes made since the snapshot was written.
+type jsonStorage struct {
+	path string
+}
+
+func (js jsonStorage) walPath() string {
+	return walPath(js.path)
+}
+
+func walPath(path string) string {
+	return path + ".wal"
+}
+
+func (js jsonStorage) load() (Schema, error) {
+	data, err := readSnapshot(js.path)
+	if err != nil {
+		return Schema{}, err
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Schema{}, errors.New("could not parse json")
+	}
+
+	schema := Schema{}
+	err = json.Unmarshal(raw, &schema)
+	if err != nil {
+		return schema, errors.New("could not parse json")
+	}
+
+	return schema, nil
+}
+
+func (js jsonStorage) commit(schema Schema, changes []change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	err := appendWAL(js.walPath(), changes)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(js.walPath())
+	if err == nil && info.Size() > compactAfterBytes {
+		return js.compact(schema)
+	}
+
+	return nil
+}
+
+func (js jsonStorage) close(schema Schema) error {
+	_, err := os.Stat(js.walPath())
+	if err != nil {
+		return nil
+	}
+
+	return js.compact(schema)
+}
+
+// compact writes schema as the new snapshot and drops the write-ahead log it
+// now contains. Crashing between the two steps only means the log is
+// replayed onto a snapshot that already has its changes.
+func (js jsonStorage) compact(schema Schema) error {
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return errors.New("there was a problem saving the database")
+	}
+
+	err = writeFileAtomic(js.path, data)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(js.walPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.New("could not remove write-ahead log")
+	}
+
+	return nil
+}
+
+// readSnapshot returns the raw decoded snapshot at path with its write-ahead
+// log replayed on top. A missing snapshot starts from an empty schema.
+func readSnapshot(path string) (map[string]any, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		raw, err = json.Marshal(newSchema())
+	}
+	if err != nil {
+		return nil, errors.New("could not read database")
+	}
+
+	data := map[string]any{}
+	err = json.Unmarshal(raw, &data)
+	if err != nil {
+		return nil, errors.New("could not parse json")
+	}
+
+	changes, err := readWAL(walPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range changes {
+		err = applyChange(data, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// memoryStorage discards every change, leaving the DB purely in memory.
+type memoryStorage struct{}
+
+// load is never needed, committing to memory can't fail.
+func (ms memoryStorage) load() (Schema, error) {
+	return Schema{}, errors.New("there is nothing to reload from memory")
+}
+
+func (ms memoryStorage) commit(schema Schema, changes []change) error {
+	return nil
+}
+
+func (ms memoryStorage) close(schema Schema) error {
+	return nil
+}
+
+func newSchema() Schema {
+	schema := Schema{
+		Version:       len(jsonMigrations),
+		Chirps:        map[int]Chirp{},
+		Users:         map[int]User{},
+		RefreshTokens: map[string]RefreshToken{},
+		Sessions:      map[string]Session{},
+		Revisions:     map[int]Revision{},
+		Likes:         map[int]Like{},
+		Follows:       map[int]Follow{},
+		Sequences:     map[string]int{},
+	}
+	schema.buildIndexes()
+
+	return schema
+}
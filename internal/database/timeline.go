@@ -0,0 +1,66 @@
+package database
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// timelineHead is the next chirp to take from one author's chirps, which
+// are walked from newest to oldest.
+type timelineHead struct {
+	ids []int
+	i   int
+}
+
+// timelineHeap orders authors by their next chirp, newest first.
+type timelineHeap []*timelineHead
+
+func (h timelineHeap) Len() int { return len(h) }
+
+func (h timelineHeap) Less(i, j int) bool {
+	return h[i].ids[h[i].i] > h[j].ids[h[j].i]
+}
+
+func (h timelineHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *timelineHeap) Push(x any) { *h = append(*h, x.(*timelineHead)) }
+
+func (h *timelineHeap) Pop() any {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
+
+// timeline merges the chirps of authorIDs newest first, starting below
+// beforeID when it isn't 0. It stops after limit chirps, 0 takes them all.
+func (s *Schema) timeline(authorIDs []int, beforeID int, limit int) []Chirp {
+	h := timelineHeap{}
+	for _, authorID := range authorIDs {
+		ids := s.chirpsByAuthor[authorID]
+
+		end := len(ids)
+		if beforeID != 0 {
+			end = sort.SearchInts(ids, beforeID)
+		}
+		if end > 0 {
+			h = append(h, &timelineHead{ids: ids, i: end - 1})
+		}
+	}
+	heap.Init(&h)
+
+	chirps := []Chirp{}
+	for h.Len() > 0 && (limit == 0 || len(chirps) < limit) {
+		head := h[0]
+		chirps = append(chirps, s.Chirps[head.ids[head.i]])
+
+		head.i--
+		if head.i < 0 {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+
+	return chirps
+}
@@ -0,0 +1,26 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused means a token that was already rotated was
+	// presented again, so it has probably leaked. Its family is revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// newTokenFamily returns the ID for a new chain of refresh tokens. Each
+// login starts a family and every rotation stays in it.
+func newTokenFamily() (string, error) {
+	family := make([]byte, 16)
+	_, err := rand.Read(family)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(family), nil
+}
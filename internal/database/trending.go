@@ -0,0 +1,137 @@
+package database
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTrendingWindows are the windows trends are kept over unless
+// Config.TrendingWindows says otherwise.
+var DefaultTrendingWindows = []time.Duration{time.Hour, 24 * time.Hour}
+
+var ErrUnknownWindow = errors.New("unknown trending window")
+
+// minTrendScore is the score below which a tag no longer counts as
+// trending and is forgotten.
+const minTrendScore = 0.01
+
+// TrendingQuery picks the window to rank tags over. A zero Window is the
+// first configured one and a zero Limit returns every trending tag.
+type TrendingQuery struct {
+	Window time.Duration
+	Limit  int
+}
+
+// TrendingTag is a hashtag and its decayed count: each use counts 1 when it
+// is made and decays exponentially with the window as its time constant,
+// so a tag used at a steady rate scores about its uses per window.
+type TrendingTag struct {
+	Tag   string  `json:"tag"`
+	Score float64 `json:"score"`
+}
+
+// decayedCount is a score as of at.
+type decayedCount struct {
+	score float64
+	at    time.Time
+}
+
+func (c decayedCount) scoreAt(now time.Time, window time.Duration) float64 {
+	return c.score * decay(now.Sub(c.at), window)
+}
+
+func decay(age time.Duration, window time.Duration) float64 {
+	return math.Exp(-age.Seconds() / window.Seconds())
+}
+
+// trendTracker keeps decayed hashtag counts for each window. It's updated
+// as chirps come and go, so ranking never has to look at the chirps.
+type trendTracker struct {
+	mu      sync.Mutex
+	windows []time.Duration
+	counts  map[time.Duration]map[string]decayedCount
+}
+
+func newTrendTracker(windows []time.Duration) *trendTracker {
+	t := &trendTracker{
+		windows: windows,
+		counts:  map[time.Duration]map[string]decayedCount{},
+	}
+	for _, window := range windows {
+		t.counts[window] = map[string]decayedCount{}
+	}
+	return t
+}
+
+// addChirp counts the hashtags of chirp at the time it was created.
+func (t *trendTracker) addChirp(chirp Chirp) {
+	t.update(chirp, 1, time.Now())
+}
+
+// removeChirp takes back what addChirp counted for chirp.
+func (t *trendTracker) removeChirp(chirp Chirp) {
+	t.update(chirp, -1, time.Now())
+}
+
+func (t *trendTracker) update(chirp Chirp, delta float64, now time.Time) {
+	tags := hashtags(chirp.Entities)
+	if len(tags) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, window := range t.windows {
+		weight := delta * decay(now.Sub(chirp.CreatedAt), window)
+		for _, tag := range tags {
+			count := t.counts[window][tag]
+			score := count.scoreAt(now, window) + weight
+			if score < minTrendScore {
+				delete(t.counts[window], tag)
+				continue
+			}
+			t.counts[window][tag] = decayedCount{score: score, at: now}
+		}
+	}
+}
+
+// top ranks the tags trending at now, highest score first.
+func (t *trendTracker) top(query TrendingQuery, now time.Time) ([]TrendingTag, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	window := query.Window
+	if window == 0 && len(t.windows) > 0 {
+		window = t.windows[0]
+	}
+	counts, ok := t.counts[window]
+	if !ok {
+		return nil, ErrUnknownWindow
+	}
+
+	tags := []TrendingTag{}
+	for tag, count := range counts {
+		score := count.scoreAt(now, window)
+		if score < minTrendScore {
+			delete(counts, tag)
+			continue
+		}
+		tags = append(tags, TrendingTag{Tag: tag, Score: score})
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Score != tags[j].Score {
+			return tags[i].Score > tags[j].Score
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	if query.Limit > 0 && len(tags) > query.Limit {
+		tags = tags[:query.Limit]
+	}
+
+	return tags, nil
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func trendTags(tags []TrendingTag) string {
+	names := []string{}
+	for _, tag := range tags {
+		names = append(names, tag.Tag)
+	}
+	return fmt.Sprint(names)
+}
+
+func TestTrendTrackerDecay(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tagged := func(body string, at time.Time) Chirp {
+		return Chirp{Entities: parseEntities(body), CreatedAt: at}
+	}
+
+	trends := newTrendTracker([]time.Duration{time.Hour, 24 * time.Hour})
+
+	// A burst of #new just now against a steady #old over the past day
+	for i := 0; i < 24; i++ {
+		at := start.Add(-time.Duration(i) * time.Hour)
+		trends.update(tagged("#old", at), 1, start)
+		trends.update(tagged("#old #OLD", at), 1, start)
+	}
+	for i := 0; i < 4; i++ {
+		trends.update(tagged("#new", start), 1, start)
+	}
+
+	hour, _ := trends.top(TrendingQuery{}, start)
+	if trendTags(hour) != "[new old]" {
+		t.Errorf("Expected #new to lead the hour but got %v", hour)
+	}
+	day, _ := trends.top(TrendingQuery{Window: 24 * time.Hour}, start)
+	if trendTags(day) != "[old new]" {
+		t.Errorf("Expected #old to lead the day but got %v", day)
+	}
+
+	// Scores decay the same whether they're read or updated later
+	later := start.Add(time.Hour)
+	trends.update(tagged("#new", start), -1, later)
+	hour, _ = trends.top(TrendingQuery{}, later)
+	if len(hour) != 2 || hour[1].Tag != "new" || math.Abs(hour[1].Score-3/math.E) > 1e-9 {
+		t.Errorf("Expected #new to score %v an hour on but got %v", 3/math.E, hour)
+	}
+
+	// Long quiet tags drop out
+	tags, _ := trends.top(TrendingQuery{}, start.Add(24*time.Hour))
+	if len(tags) != 0 {
+		t.Errorf("Expected nothing trending a day later but got %v", tags)
+	}
+
+	_, err := trends.top(TrendingQuery{Window: time.Minute}, start)
+	if err != ErrUnknownWindow {
+		t.Errorf("Expected an unknown window to be rejected but got %v", err)
+	}
+}
+
+func TestTrending(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		db.CreateChirp(1, "#go #Go")                   // 1
+		db.CreateChirp(1, "#go and #sqlite")           // 2
+		db.CreateChirp(2, "#rust")                     // 3
+		db.CreateChirp(2, "#rust #go")                 // 4
+		db.CreateQuote(2, 3, "#rust")                  // 5
+		db.CreateChirp(2, "no tags")                   // 6
+		db.CreateChirp(1, "#go again")                 // 7
+		db.UpdateChirp(1, 2, "#sqlite only, then #go") // 2
+
+		tags, err := db.Trending(TrendingQuery{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if trendTags(tags) != "[go rust sqlite]" || math.Abs(tags[0].Score-4) > 0.01 {
+			t.Errorf("Expected [go rust sqlite] with #go near 4 but got %v", tags)
+		}
+
+		// Quotes outlive the chirp they quote
+		db.DeleteChirp(2, 4)
+		db.DeleteChirp(2, 3)
+
+		tags, _ = db.Trending(TrendingQuery{Window: 24 * time.Hour, Limit: 1})
+		if trendTags(tags) != "[go]" || math.Abs(tags[0].Score-3) > 0.01 {
+			t.Errorf("Expected #go near 3 after deletes but got %v", tags)
+		}
+		tags, _ = db.Trending(TrendingQuery{Window: 24 * time.Hour})
+		if len(tags) != 3 || math.Abs(tags[1].Score-1) > 0.01 {
+			t.Errorf("Expected #rust and #sqlite near 1 after deletes but got %v", tags)
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// change is a single mutation of one entry in a Schema table. Values are
+// whole entries so replaying a change more than once is harmless.
+type change struct {
+	Table string          `json:"table"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"` // omitted for deletes
+}
+
+func putChange(table string, key any, value any) change {
+	data, _ := json.Marshal(value)
+	return change{
+		Table: table,
+		Key:   fmt.Sprint(key),
+		Value: data,
+	}
+}
+
+func deleteChange(table string, key any) change {
+	return change{
+		Table: table,
+		Key:   fmt.Sprint(key),
+	}
+}
+
+// applyChange replays c onto the raw decoded JSON of a snapshot.
+func applyChange(data map[string]any, c change) error {
+	table, ok := data[c.Table].(map[string]any)
+	if !ok {
+		table = map[string]any{}
+		data[c.Table] = table
+	}
+
+	if c.Value == nil {
+		delete(table, c.Key)
+		return nil
+	}
+
+	var value any
+	err := json.Unmarshal(c.Value, &value)
+	if err != nil {
+		return errors.New("could not parse write-ahead log")
+	}
+
+	table[c.Key] = value
+	return nil
+}
+
+// readWAL returns every complete record in the log at path. A record is
+// only complete once its newline is written, so a torn last line from a crash
+// mid-append is skipped. Any other line that can't be decoded is corruption.
+func readWAL(path string) ([]change, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []change{}, nil
+	}
+	if err != nil {
+		return nil, errors.New("could not read write-ahead log")
+	}
+
+	// Drop the torn tail, everything before the last newline is complete
+	raw = raw[:bytes.LastIndexByte(raw, '\n')+1]
+
+	changes := []change{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(raw)+1)
+	for line := 1; scanner.Scan(); line++ {
+		c := change{}
+		err = json.Unmarshal(scanner.Bytes(), &c)
+		if err != nil {
+			return nil, fmt.Errorf("write-ahead log is corrupt at line %d", line)
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+// appendWAL durably appends changes to the log at path.
+func appendWAL(path string, changes []change) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.New("could not open write-ahead log")
+	}
+	defer file.Close()
+
+	buf := bytes.Buffer{}
+
+	err = truncateTornRecord(file)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(&buf)
+	for _, c := range changes {
+		err = encoder.Encode(c)
+		if err != nil {
+			return errors.New("could not encode write-ahead log")
+		}
+	}
+
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		return errors.New("could not write to write-ahead log")
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return errors.New("could not sync write-ahead log")
+	}
+
+	return nil
+}
+
+// truncateTornRecord cuts a record left half written by a crash off the end
+// of the log, so the next append starts on a fresh line.
+func truncateTornRecord(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return nil
+	}
+
+	last := make([]byte, 1)
+	_, err = file.ReadAt(last, info.Size()-1)
+	if err != nil || last[0] == '\n' {
+		return nil
+	}
+
+	raw := make([]byte, info.Size())
+	_, err = file.ReadAt(raw, 0)
+	if err != nil {
+		return errors.New("could not read write-ahead log")
+	}
+
+	err = file.Truncate(int64(bytes.LastIndexByte(raw, '\n') + 1))
+	if err != nil {
+		return errors.New("could not repair write-ahead log")
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data so that readers see either the old
+// or the new contents, never a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return errors.New("could not create the database file")
+	}
+	defer os.Remove(file.Name())
+
+	// CreateTemp makes the file private, match what os.Create would give
+	file.Chmod(0644)
+
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return errors.New("there was a problem saving the database")
+	}
+
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return errors.New("there was a problem saving the database")
+	}
+
+	err = file.Close()
+	if err != nil {
+		return errors.New("there was a problem saving the database")
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return errors.New("there was a problem saving the database")
+	}
+
+	// Sync the directory so the rename itself survives a crash
+	d, err := os.Open(dir)
+	if err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := newTestDB(t, path)
+	chirp, err := db.CreateChirp(1, "logged")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db.CreateChirp(1, "deleted")
+	db.DeleteChirp(1, 2)
+
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("Expected changes to only be in the write-ahead log")
+	}
+
+	// Simulate a crash part way through appending a record, then make sure
+	// appending after it does not lose the next one
+	file, _ := os.OpenFile(walPath(path), os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"table":"chirps","key":"3","val`)
+	file.Close()
+
+	second, err := db.CreateChirp(1, "after crash")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	page, err := newTestDB(t, path).ListChirps(ChirpQuery{})
+	chirps := page.Chirps
+	if err != nil || len(chirps) != 2 || !reflect.DeepEqual(chirps, []Chirp{chirp, second}) {
+		t.Errorf("Expected '%v' and '%v' after replay but got '%v' (%v)", chirp, second, chirps, err)
+	}
+
+	if _, err := os.Stat(walPath(path)); err == nil {
+		t.Errorf("Expected opening to compact the write-ahead log")
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := newTestDB(t, path)
+	db.StartFlusher(time.Hour)
+
+	chirp, err := db.CreateChirp(1, "buffered")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	read, _ := db.ReadChirp(chirp.ID)
+	if !reflect.DeepEqual(read, chirp) {
+		t.Errorf("Expected '%v' to be readable before flushing but got '%v'", chirp, read)
+	}
+
+	if _, err := os.Stat(walPath(path)); err == nil {
+		t.Errorf("Expected nothing to be written before the flush interval")
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	read, err = newTestDB(t, path).ReadChirp(chirp.ID)
+	if err != nil || !reflect.DeepEqual(read, chirp) {
+		t.Errorf("Expected '%v' to be flushed on close but got '%v' (%v)", chirp, read, err)
+	}
+}
+
+func TestWALCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := newTestDB(t, path)
+	db.CreateChirp(1, "first")
+
+	// A bad record followed by a good one can't be a torn append
+	file, _ := os.OpenFile(walPath(path), os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString("{\"table\":\"chirps\",\"key\":\"2\",\"val\n")
+	file.Close()
+	db.CreateChirp(1, "second")
+
+	_, err := NewDB(path)
+	if err == nil {
+		t.Errorf("Expected a corrupt record before the end of the log to fail opening")
+	}
+}
+
+func TestResetJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := newTestDB(t, path)
+	db.CreateChirp(1, "cleared")
+
+	Reset(Config{Driver: "json", Path: path})
+
+	if _, err := os.Stat(walPath(path)); err == nil {
+		t.Errorf("Expected reset to remove the write-ahead log")
+	}
+}
+
+// failingStorage refuses every commit, as a full or broken disk would.
+type failingStorage struct {
+	jsonStorage
+}
+
+func (fs failingStorage) commit(schema Schema, changes []change) error {
+	return errors.New("disk full")
+}
+
+func TestCommitFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := newTestDB(t, path)
+	kept, _ := db.CreateChirp(1, "kept")
+
+	db.storage = failingStorage{jsonStorage{path: path}}
+	failed, err := db.CreateChirp(1, "failed")
+	if err == nil {
+		t.Fatalf("Expected the failed write to return an error but got %v", failed)
+	}
+
+	page, _ := db.ListChirps(ChirpQuery{})
+	if len(page.Chirps) != 1 || page.Chirps[0].ID != kept.ID {
+		t.Errorf("Expected the failed chirp to be rolled back but got %v", page.Chirps)
+	}
+
+	db.storage = jsonStorage{path: path}
+	next, err := db.CreateChirp(1, "next")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	page, _ = newTestDB(t, path).ListChirps(ChirpQuery{})
+	if len(page.Chirps) != 2 || page.Chirps[0].ID != kept.ID || page.Chirps[1].ID != next.ID {
+		t.Errorf("Expected only %v and %v to be persisted but got %v", kept.ID, next.ID, page.Chirps)
+	}
+}
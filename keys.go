@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is one key in a keyring. Keys kept around after rotation only
+// have their public half, so they can verify tokens but not sign new ones.
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// keyring signs and verifies tokens. With no signing key it falls back to
+// HS256 with the shared secret. Once keys are set up the secret is no longer
+// accepted, so services that had it can't forge tokens.
+type keyring struct {
+	signing *signingKey
+	keys    map[string]*signingKey
+	secret  []byte
+}
+
+func newHMACKeyring(secret string) *keyring {
+	return &keyring{keys: map[string]*signingKey{}, secret: []byte(secret)}
+}
+
+// loadKeyring reads every .pem file in dir as a key named after the file.
+// Private keys are PKCS#8 (or PKCS#1 for RSA), public keys PKIX. signingID
+// names the private key new tokens are signed with.
+func loadKeyring(dir string, signingID string) (*keyring, error) {
+	k := &keyring{keys: map[string]*signingKey{}}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := parseSigningKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		key.id = strings.TrimSuffix(filepath.Base(path), ".pem")
+		k.keys[key.id] = key
+	}
+
+	signing, ok := k.keys[signingID]
+	if !ok {
+		return nil, fmt.Errorf("signing key %q not found in %s", signingID, dir)
+	}
+	if signing.private == nil {
+		return nil, fmt.Errorf("signing key %q is a public key", signingID)
+	}
+	k.signing = signing
+
+	return k, nil
+}
+
+func parseSigningKey(data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.private = signer
+		parsed = signer.Public()
+	}
+
+	switch public := parsed.(type) {
+	case *rsa.PublicKey:
+		key.method, key.public = jwt.SigningMethodRS256, public
+	case ed25519.PublicKey:
+		key.method, key.public = jwt.SigningMethodEdDSA, public
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	return key, nil
+}
+
+func (k *keyring) sign(claims jwt.Claims) (string, error) {
+	if k.signing == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.secret)
+	}
+
+	token := jwt.NewWithClaims(k.signing.method, claims)
+	token.Header["kid"] = k.signing.id
+	return token.SignedString(k.signing.private)
+}
+
+// keyFunc picks the key to verify a token with from its kid, and makes sure
+// the token was signed with that key's algorithm.
+func (k *keyring) keyFunc(t *jwt.Token) (any, error) {
+	if k.signing == nil {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("unexpected signing method")
+		}
+		return k.secret, nil
+	}
+
+	kid, ok := t.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("missing kid")
+	}
+
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown key")
+	}
+	if t.Method != key.method {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.public, nil
+}
+
+// jwk is a public key in JSON Web Key format.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// jwks returns the public keys tokens can be verified with. The HS256
+// secret is never published.
+func (k *keyring) jwks() []jwk {
+	keys := []jwk{}
+	for _, key := range k.keys {
+		entry := jwk{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			entry.Kty = "RSA"
+			entry.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			entry.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			entry.Kty = "OKP"
+			entry.Crv = "Ed25519"
+			entry.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		keys = append(keys, entry)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Kid < keys[j].Kid
+	})
+	return keys
+}
+
+// jwks publishes the verification keys so other services can check Chirpy
+// tokens without sharing a secret.
+func (cfg *apiConfig) jwks(w http.ResponseWriter, r *http.Request) {
+	response := struct {
+		Keys []jwk `json:"keys"`
+	}{
+		Keys: cfg.keys.jwks(),
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, 200, response)
+}
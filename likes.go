@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/honesea/go-chirpy/internal/database"
+)
+
+// chirpResponse is a chirp as seen by the user making the request.
+type chirpResponse struct {
+	database.Chirp
+	LikedByMe bool `json:"liked_by_me"`
+	// Author is only filled in for ?expand=author
+	Author *database.Profile `json:"author,omitempty"`
+}
+
+type chirpPageResponse struct {
+	Chirps     []chirpResponse `json:"chirps"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// viewer is who chirps are shown to and how.
+type viewer struct {
+	// userID is 0 for anonymous requests
+	userID       int
+	expandAuthor bool
+}
+
+// viewer reads the optional authentication and the expand query parameter,
+// a comma separated list such as expand=author.
+func (cfg *apiConfig) viewer(r *http.Request) viewer {
+	v := viewer{}
+
+	userId, err := cfg.authenticate(r.Header.Get("Authorization"))
+	if err == nil {
+		v.userID = userId
+	}
+
+	for _, expand := range strings.Split(r.URL.Query().Get("expand"), ",") {
+		if strings.TrimSpace(expand) == "author" {
+			v.expandAuthor = true
+		}
+	}
+
+	return v
+}
+
+// likedID is the chirp likes of chirp are stored on, likes of a rechirp go
+// to the chirp it reposts.
+func likedID(chirp database.Chirp) int {
+	if chirp.RechirpOf != 0 {
+		return chirp.RechirpOf
+	}
+	return chirp.ID
+}
+
+func (cfg *apiConfig) chirpResponses(v viewer, chirps []database.Chirp) ([]chirpResponse, error) {
+	chirpIDs := []int{}
+	authorIDs := []int{}
+	for _, chirp := range chirps {
+		chirpIDs = append(chirpIDs, likedID(chirp))
+		authorIDs = append(authorIDs, chirp.AuthorID)
+	}
+
+	liked := map[int]bool{}
+	if v.userID != 0 {
+		var err error
+		liked, err = cfg.db.LikedChirps(v.userID, chirpIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	authors := map[int]database.User{}
+	if v.expandAuthor {
+		var err error
+		authors, err = cfg.db.ReadUsers(authorIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	responses := []chirpResponse{}
+	for _, chirp := range chirps {
+		response := chirpResponse{
+			Chirp:     chirp,
+			LikedByMe: liked[likedID(chirp)],
+		}
+		if author, ok := authors[chirp.AuthorID]; ok {
+			profile := author.Profile()
+			response.Author = &profile
+		}
+		responses = append(responses, response)
+	}
+
+	return responses, nil
+}
+
+func (cfg *apiConfig) chirpResponse(v viewer, chirp database.Chirp) (chirpResponse, error) {
+	responses, err := cfg.chirpResponses(v, []database.Chirp{chirp})
+	if err != nil {
+		return chirpResponse{}, err
+	}
+	return responses[0], nil
+}
+
+func (cfg *apiConfig) pageResponse(v viewer, page database.ChirpPage) (chirpPageResponse, error) {
+	chirps, err := cfg.chirpResponses(v, page.Chirps)
+	if err != nil {
+		return chirpPageResponse{}, err
+	}
+
+	return chirpPageResponse{
+		Chirps:     chirps,
+		NextCursor: page.NextCursor,
+	}, nil
+}
+
+func (cfg *apiConfig) likeChirp(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	chirpIDParam := chi.URLParam(r, "chirp_id")
+	chirpID, err := strconv.Atoi(chirpIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "Chirp ID must be an integer")
+		return
+	}
+
+	chirp, err := cfg.db.LikeChirp(userId, chirpID)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, "Chirp doesn't exist")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem liking the chirp")
+		return
+	}
+
+	respondWithJSON(w, 200, chirpResponse{Chirp: chirp, LikedByMe: true})
+}
+
+func (cfg *apiConfig) unlikeChirp(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	chirpIDParam := chi.URLParam(r, "chirp_id")
+	chirpID, err := strconv.Atoi(chirpIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "Chirp ID must be an integer")
+		return
+	}
+
+	chirp, err := cfg.db.UnlikeChirp(userId, chirpID)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, "Chirp doesn't exist")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem unliking the chirp")
+		return
+	}
+
+	respondWithJSON(w, 200, chirpResponse{Chirp: chirp, LikedByMe: false})
+}
+
+func (cfg *apiConfig) listLikes(w http.ResponseWriter, r *http.Request) {
+	userIDParam := chi.URLParam(r, "user_id")
+	userID, err := strconv.Atoi(userIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "User ID must be an integer")
+		return
+	}
+
+	limit, cursor, paginated, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if !paginated {
+		limit = defaultPageSize
+	}
+
+	page, err := cfg.db.ListLikes(database.LikeQuery{
+		UserID: userID,
+		Limit:  limit,
+		Cursor: cursor,
+	})
+	if errors.Is(err, database.ErrInvalidCursor) {
+		respondWithError(w, 400, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving likes")
+		return
+	}
+
+	response, err := cfg.pageResponse(cfg.viewer(r), page)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving likes")
+		return
+	}
+
+	setNextLink(w, r, limit, page.NextCursor)
+	respondWithJSON(w, 200, response)
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/honesea/go-chirpy/internal/database"
@@ -17,32 +24,185 @@ func main() {
 		return
 	}
 
+	dbg := flag.Bool("debug", false, "Enable debug mode")
+	flag.Parse()
+
+	// DB_DRIVER picks the storage backend (json or sqlite), DB_PATH
+	// overrides its default file and ID_STRATEGY picks sequence or
+	// snowflake IDs.
+	dbConfig := database.Config{
+		Driver: os.Getenv("DB_DRIVER"),
+		Path:   os.Getenv("DB_PATH"),
+		IDs:    os.Getenv("ID_STRATEGY"),
+	}
+
+	// DB_FLUSH_INTERVAL sets how often the JSON backend writes to disk,
+	// 0 writes every change straight away
+	dbConfig.FlushInterval = time.Second
+	if interval := os.Getenv("DB_FLUSH_INTERVAL"); interval != "" {
+		dbConfig.FlushInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Printf("invalid DB_FLUSH_INTERVAL: %v", err)
+			return
+		}
+	}
+
+	// TRENDING_WINDOWS lists the windows hashtag trends are kept over,
+	// such as 1h,24h
+	if windows := os.Getenv("TRENDING_WINDOWS"); windows != "" {
+		for _, window := range strings.Split(windows, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(window))
+			if err != nil || d <= 0 {
+				log.Printf("invalid TRENDING_WINDOWS: %q", window)
+				return
+			}
+			dbConfig.TrendingWindows = append(dbConfig.TrendingWindows, d)
+		}
+	}
+
+	// ACCOUNT_DELETION_GRACE_PERIOD is how long deleted accounts can be
+	// restored before they are purged
+	deletionGracePeriod := defaultDeletionGracePeriod
+	if grace := os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD"); grace != "" {
+		deletionGracePeriod, err = time.ParseDuration(grace)
+		if err != nil || deletionGracePeriod < 0 {
+			log.Printf("invalid ACCOUNT_DELETION_GRACE_PERIOD: %q", grace)
+			return
+		}
+	}
+
+	// ACCESS_TOKEN_LIFETIME and REFRESH_TOKEN_LIFETIME are how long tokens
+	// last unless the client asks for another lifetime at login, which is
+	// capped by the _MAX_ variants
+	accessLifetime, refreshLifetime := defaultAccessLifetime, defaultRefreshLifetime
+	for name, lifetime := range map[string]*time.Duration{
+		"ACCESS_TOKEN_LIFETIME":      &accessLifetime.Default,
+		"ACCESS_TOKEN_MAX_LIFETIME":  &accessLifetime.Max,
+		"REFRESH_TOKEN_LIFETIME":     &refreshLifetime.Default,
+		"REFRESH_TOKEN_MAX_LIFETIME": &refreshLifetime.Max,
+	} {
+		if value := os.Getenv(name); value != "" {
+			*lifetime, err = time.ParseDuration(value)
+			if err != nil || *lifetime <= 0 {
+				log.Printf("invalid %s: %q", name, value)
+				return
+			}
+		}
+	}
+	if accessLifetime.Default > accessLifetime.Max || refreshLifetime.Default > refreshLifetime.Max {
+		log.Printf("token lifetimes can't be longer than their max")
+		return
+	}
+
+	if flag.Arg(0) == "migrate" {
+		err = runMigrate(dbConfig, flag.Arg(1))
+		if err != nil {
+			log.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Clear db if exists
+	if *dbg {
+		database.Reset(dbConfig)
+	}
+
+	err = runMigrate(dbConfig, "up")
+	if err != nil {
+		log.Printf("could not migrate database: %v", err)
+		return
+	}
+
+	// JWT_KEYS_DIR holds the RS256 or EdDSA keys tokens are signed and
+	// verified with and JWT_SIGNING_KEY_ID picks the one to sign with.
+	// Without them tokens are signed HS256 with JWT_SECRET, which stops being
+	// accepted once keys are set up.
+	keys := newHMACKeyring(os.Getenv("JWT_SECRET"))
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		keys, err = loadKeyring(dir, os.Getenv("JWT_SIGNING_KEY_ID"))
+		if err != nil {
+			log.Printf("could not load JWT keys: %v", err)
+			return
+		}
+	}
+
+	// EXPORT_SIGNING_SECRET signs export download links, without it exports
+	// are turned off
+	exportSecret := os.Getenv("EXPORT_SIGNING_SECRET")
+	if exportSecret == "" {
+		log.Printf("EXPORT_SIGNING_SECRET is not set, data exports are disabled")
+	}
+
+	db, err := database.Open(dbConfig)
+	if err != nil {
+		log.Printf("could not open database: %v", err)
+		return
+	}
+	defer db.Close()
+
 	r := chi.NewRouter()
 	admin := chi.NewRouter()
 	api := chi.NewRouter()
 	cfg := apiConfig{
-		db:          database.NewDB(),
-		jwtSecret:   os.Getenv("JWT_SECRET"),
+		db:          db,
 		polkaApiKey: os.Getenv("POLKA_API_KEY"),
+		keys:        keys,
+
+		accessLifetime:  accessLifetime,
+		refreshLifetime: refreshLifetime,
+
+		deletionGracePeriod: deletionGracePeriod,
+		exports:             newExports(),
+		exportSecret:        exportSecret,
 	}
 
 	fileServer := cfg.middlewareMetricsInc(http.FileServer(http.Dir(".")))
 
 	r.Handle("/app", http.StripPrefix("/app", fileServer))
 	r.Handle("/app/*", http.StripPrefix("/app", fileServer))
+	r.Get("/.well-known/jwks.json", cfg.jwks)
 
 	api.Get("/healthz", cfg.healthz)
 	api.Get("/metrics", cfg.metrics)
 	api.Get("/reset", cfg.reset)
 	api.Get("/chirps", cfg.listChirps)
 	api.Post("/chirps", cfg.createChirp)
+	api.Get("/chirps/search", cfg.searchChirps)
+	api.Put("/chirps/{chirp_id}", cfg.updateChirp)
+	api.Patch("/chirps/{chirp_id}", cfg.updateChirp)
 	api.Delete("/chirps/{chirp_id}", cfg.deleteChirp)
 	api.Get("/chirps/{chirp_id}", cfg.readChirp)
+	api.Get("/chirps/{chirp_id}/revisions", cfg.listRevisions)
+	api.Get("/chirps/{chirp_id}/thread", cfg.readThread)
+	api.Post("/chirps/{chirp_id}/rechirp", cfg.rechirp)
+	api.Delete("/chirps/{chirp_id}/rechirp", cfg.unrechirp)
+	api.Post("/chirps/{chirp_id}/likes", cfg.likeChirp)
+	api.Delete("/chirps/{chirp_id}/likes", cfg.unlikeChirp)
+	api.Get("/hashtags/{tag}/chirps", cfg.listHashtag)
+	api.Get("/trending", cfg.trending)
 	api.Post("/users", cfg.createUser)
 	api.Put("/users", cfg.updateUser)
+	api.Delete("/users", cfg.deleteUser)
+	api.Post("/users/restore", cfg.restoreUser)
+	api.Post("/users/export", cfg.createExport)
+	api.Get("/users/export/{export_id}", cfg.readExport)
+	api.Patch("/users", cfg.updateProfile)
+	api.Get("/users/{user_id}", cfg.readProfile)
+	api.Get("/users/{user_id}/likes", cfg.listLikes)
+	api.Get("/users/{user_id}/mentions", cfg.listMentions)
+	api.Post("/users/{user_id}/follow", cfg.follow)
+	api.Delete("/users/{user_id}/follow", cfg.unfollow)
+	api.Get("/users/{user_id}/followers", cfg.listFollowers)
+	api.Get("/users/{user_id}/following", cfg.listFollowing)
+	api.Get("/timeline", cfg.timeline)
+	api.Get("/exports/{export_id}/download", cfg.downloadExport)
 	api.Post("/login", cfg.login)
 	api.Post("/refresh", cfg.refresh)
 	api.Post("/revoke", cfg.revoke)
+	api.Get("/sessions", cfg.listSessions)
+	api.Delete("/sessions", cfg.revokeSessions)
+	api.Delete("/sessions/{session_id}", cfg.revokeSession)
 	api.Post("/polka/webhooks", cfg.polkaWebhook)
 
 	admin.Get("/metrics", cfg.adminMetrics)
@@ -55,11 +215,24 @@ func main() {
 		Handler: middlewareCors(r),
 	}
 
+	// Shut down cleanly on ctrl-c or SIGTERM so the deferred db.Close
+	// flushes any buffered writes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	go purgeDeletedUsers(ctx, db, deletionGracePeriod, purgeInterval)
+	go sweepRefreshTokens(ctx, db, tokenSweepInterval)
+
 	log.Println("server starting")
 	err = server.ListenAndServe()
 
-	if err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Printf("error: %v\n", err)
-		log.Println("server closing")
 	}
+	log.Println("server closing")
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/honesea/go-chirpy/internal/database"
+)
+
+// runMigrate handles the `go-chirpy migrate up|down|status` subcommand.
+func runMigrate(dbConfig database.Config, command string) error {
+	migrator, err := database.NewMigrator(dbConfig)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	switch command {
+	case "up":
+		return migrator.MigrateUp()
+	case "down":
+		return migrator.MigrateDown()
+	case "status":
+		status, err := migrator.MigrationStatus()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Schema version %d of %d\n\n", status.Current, status.Latest)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS")
+		for _, m := range status.Migrations {
+			state := "pending"
+			if m.Applied {
+				state = "applied"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, state)
+		}
+		return w.Flush()
+	}
+
+	return errors.New("usage: go-chirpy migrate up|down|status")
+}
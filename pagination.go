@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// parsePage reads the limit and cursor query parameters. paginated is false
+// when the client sent neither, so older clients keep getting plain arrays.
+func parsePage(r *http.Request) (limit int, cursor string, paginated bool, err error) {
+	limitStr := r.URL.Query().Get("limit")
+	cursor = r.URL.Query().Get("cursor")
+
+	if limitStr == "" && cursor == "" {
+		return 0, "", false, nil
+	}
+
+	limit = defaultPageSize
+	if limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return 0, "", false, errors.New("limit must be a positive integer")
+		}
+	}
+
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	return limit, cursor, true, nil
+}
+
+// setNextLink points a Link header at the page after this one, keeping the
+// rest of the request's query intact.
+func setNextLink(w http.ResponseWriter, r *http.Request, limit int, nextCursor string) {
+	if nextCursor == "" {
+		return
+	}
+
+	query := r.URL.Query()
+	query.Set("cursor", nextCursor)
+	query.Set("limit", strconv.Itoa(limit))
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	next := fmt.Sprintf("%s://%s%s?%s", scheme, r.Host, r.URL.Path, query.Encode())
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next))
+}
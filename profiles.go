@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/honesea/go-chirpy/internal/database"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxAvatarURLLength   = 2048
+)
+
+// readProfile looks a user up by ID or by handle, with or without the @.
+func (cfg *apiConfig) readProfile(w http.ResponseWriter, r *http.Request) {
+	idOrHandle := chi.URLParam(r, "user_id")
+
+	var user database.User
+	userID, err := strconv.Atoi(idOrHandle)
+	if err == nil {
+		user, err = cfg.db.ReadUser(userID)
+	} else {
+		user, err = cfg.db.ReadUserByHandle(idOrHandle)
+	}
+	if errors.Is(err, database.ErrUserNotFound) || (err == nil && user.DeletedAt != nil) {
+		respondWithError(w, 404, "User doesn't exist")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving the user")
+		return
+	}
+
+	respondWithJSON(w, 200, user.Profile())
+}
+
+// updateProfile changes the profile fields sent, leaving the rest alone.
+func (cfg *apiConfig) updateProfile(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	type parameters struct {
+		Handle      *string `json:"handle"`
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		AvatarURL   *string `json:"avatar_url"`
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+
+	if err != nil {
+		respondWithError(w, 500, "Something went wrong")
+		return
+	}
+
+	if params.Handle != nil && *params.Handle != "" && !database.ValidHandle(*params.Handle) {
+		respondWithError(w, 400, "Handles are up to 15 letters, digits or underscores and can't be all digits")
+		return
+	}
+	if params.DisplayName != nil && utf8.RuneCountInString(*params.DisplayName) > maxDisplayNameLength {
+		respondWithError(w, 400, "Display name is too long")
+		return
+	}
+	if params.Bio != nil && utf8.RuneCountInString(*params.Bio) > maxBioLength {
+		respondWithError(w, 400, "Bio is too long")
+		return
+	}
+	if params.AvatarURL != nil && *params.AvatarURL != "" && !validAvatarURL(*params.AvatarURL) {
+		respondWithError(w, 400, "Avatar must be an http or https URL")
+		return
+	}
+
+	user, err := cfg.db.UpdateProfile(userId, database.ProfileUpdate{
+		Handle:      params.Handle,
+		DisplayName: params.DisplayName,
+		Bio:         params.Bio,
+		AvatarURL:   params.AvatarURL,
+	})
+	if errors.Is(err, database.ErrHandleTaken) {
+		respondWithError(w, 409, "Handle is already taken")
+		return
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, 404, "User doesn't exist")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem updating the profile")
+		return
+	}
+
+	respondWithJSON(w, 200, user)
+}
+
+func validAvatarURL(avatarURL string) bool {
+	if len(avatarURL) > maxAvatarURLLength {
+		return false
+	}
+
+	u, err := url.Parse(avatarURL)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
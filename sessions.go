@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/honesea/go-chirpy/internal/database"
+)
+
+// tokenSweepInterval is how often expired and revoked refresh tokens are
+// cleared out.
+const tokenSweepInterval = time.Hour
+
+// device describes where r came from. Clients can name the device when they
+// log in, otherwise it's left for them to recognise by its user agent.
+func device(r *http.Request, name string) database.Device {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return database.Device{
+		Name:      name,
+		UserAgent: r.UserAgent(),
+		IP:        ip,
+	}
+}
+
+func (cfg *apiConfig) listSessions(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	sessions, err := cfg.db.ListSessions(userId)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving sessions")
+		return
+	}
+
+	respondWithJSON(w, 200, sessions)
+}
+
+// revokeSession logs one device out. Its access tokens keep working until
+// they expire, but it can't refresh them.
+func (cfg *apiConfig) revokeSession(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	err = cfg.db.RevokeSession(userId, chi.URLParam(r, "session_id"))
+	if errors.Is(err, database.ErrSessionNotFound) {
+		respondWithError(w, 404, "Session doesn't exist")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem revoking the session")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// revokeSessions logs the caller out everywhere, including the device
+// making the request.
+func (cfg *apiConfig) revokeSessions(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	userId, err := cfg.authenticate(auth)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	err = cfg.db.RevokeSessions(userId)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem revoking the sessions")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// sweepRefreshTokens purges expired and revoked refresh tokens every
+// interval until ctx is done.
+func sweepRefreshTokens(ctx context.Context, db database.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := db.PurgeExpiredTokens(time.Now())
+		if err != nil {
+			log.Printf("could not purge refresh tokens: %v", err)
+		} else if purged > 0 {
+			log.Printf("purged %d expired or revoked refresh tokens", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/honesea/go-chirpy/internal/database"
+)
+
+const (
+	defaultThreadDepth = 3
+	maxThreadDepth     = 10
+	// threadReplyPageSize is how many replies each nested level shows, the
+	// requested limit only applies to the direct replies
+	threadReplyPageSize = 5
+	// maxThreadNodes caps the replies loaded for one thread
+	maxThreadNodes = 200
+)
+
+// threadNode is a chirp with a page of its replies. Replies is left out
+// below the depth limit or once the thread is full, clients fetch that
+// node's own thread to go deeper, or page its replies with NextCursor.
+type threadNode struct {
+	chirpResponse
+	Replies    []threadNode `json:"replies,omitempty"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+type thread struct {
+	// Ancestors leads from the start of the conversation down to the
+	// requested chirp, stopping early at a deleted chirp
+	Ancestors []chirpResponse `json:"ancestors"`
+	Chirp     threadNode      `json:"chirp"`
+}
+
+func (cfg *apiConfig) readThread(w http.ResponseWriter, r *http.Request) {
+	chirpIDParam := chi.URLParam(r, "chirp_id")
+	chirpID, err := strconv.Atoi(chirpIDParam)
+
+	if err != nil {
+		respondWithError(w, 400, "Chirp ID must be an integer")
+		return
+	}
+
+	depth := defaultThreadDepth
+	if depthStr := r.URL.Query().Get("depth"); depthStr != "" {
+		depth, err = strconv.Atoi(depthStr)
+		if err != nil || depth < 0 {
+			respondWithError(w, 400, "depth must be a non-negative integer")
+			return
+		}
+	}
+	if depth > maxThreadDepth {
+		depth = maxThreadDepth
+	}
+
+	// Every level is paged, the limit and cursor only apply to the direct
+	// replies
+	limit, cursor, paginated, err := parsePage(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if !paginated {
+		limit = defaultPageSize
+	}
+
+	chirp, err := cfg.db.ReadChirp(chirpID)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving chirps")
+		return
+	}
+	if chirp.ID == 0 {
+		respondWithError(w, 404, "Chirp doesn't exist")
+		return
+	}
+
+	v := cfg.viewer(r)
+
+	ancestors, err := cfg.ancestors(chirp)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving chirps")
+		return
+	}
+	ancestorResponses, err := cfg.chirpResponses(v, ancestors)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving chirps")
+		return
+	}
+
+	root, err := cfg.chirpResponse(v, chirp)
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving chirps")
+		return
+	}
+
+	node, err := cfg.threadNode(v, root, depth, limit, cursor)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		respondWithError(w, 400, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving chirps")
+		return
+	}
+
+	setNextLink(w, r, limit, node.NextCursor)
+	respondWithJSON(w, 200, thread{
+		Ancestors: ancestorResponses,
+		Chirp:     node,
+	})
+}
+
+// ancestors returns the chirps chirp replies to, oldest first.
+func (cfg *apiConfig) ancestors(chirp database.Chirp) ([]database.Chirp, error) {
+	ancestors := []database.Chirp{}
+
+	for chirp.InReplyTo != 0 {
+		parent, err := cfg.db.ReadChirp(chirp.InReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		if parent.ID == 0 {
+			break
+		}
+
+		ancestors = append([]database.Chirp{parent}, ancestors...)
+		chirp = parent
+	}
+
+	return ancestors, nil
+}
+
+// threadNode loads depth levels of replies below chirp, oldest first. Levels
+// are filled breadth first so one busy reply can't use up the whole thread.
+func (cfg *apiConfig) threadNode(v viewer, chirp chirpResponse, depth int, limit int, cursor string) (threadNode, error) {
+	root := threadNode{chirpResponse: chirp}
+	budget := maxThreadNodes
+
+	level := []*threadNode{&root}
+	for ; depth > 0 && len(level) > 0 && budget > 0; depth-- {
+		next := []*threadNode{}
+		for _, node := range level {
+			if budget == 0 {
+				break
+			}
+
+			pageSize := min(limit, budget)
+			page, err := cfg.db.ListChirps(database.ChirpQuery{
+				InReplyTo: node.ID,
+				Limit:     pageSize,
+				Cursor:    cursor,
+			})
+			if err != nil {
+				return threadNode{}, err
+			}
+
+			replies, err := cfg.chirpResponses(v, page.Chirps)
+			if err != nil {
+				return threadNode{}, err
+			}
+
+			node.Replies = make([]threadNode, len(replies))
+			node.NextCursor = page.NextCursor
+			for i, reply := range replies {
+				node.Replies[i] = threadNode{chirpResponse: reply}
+				next = append(next, &node.Replies[i])
+			}
+			budget -= len(replies)
+		}
+
+		level = next
+		limit = threadReplyPageSize
+		cursor = ""
+	}
+
+	return root, nil
+}
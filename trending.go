@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/honesea/go-chirpy/internal/database"
+)
+
+const defaultTrendingLimit = 10
+
+func (cfg *apiConfig) trending(w http.ResponseWriter, r *http.Request) {
+	// window is one of the configured windows such as 1h, the first one
+	// when left out
+	var window time.Duration
+	if windowStr := r.URL.Query().Get("window"); windowStr != "" {
+		var err error
+		window, err = time.ParseDuration(windowStr)
+		if err != nil {
+			respondWithError(w, 400, "window must be a duration such as 1h")
+			return
+		}
+	}
+
+	limit := defaultTrendingLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			respondWithError(w, 400, "limit must be a positive integer")
+			return
+		}
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	tags, err := cfg.db.Trending(database.TrendingQuery{
+		Window: window,
+		Limit:  limit,
+	})
+	if errors.Is(err, database.ErrUnknownWindow) {
+		respondWithError(w, 400, "Unknown window")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "There was a problem retrieving trends")
+		return
+	}
+
+	respondWithJSON(w, 200, tags)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"log"
@@ -12,9 +14,30 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func generateAccessToken(jwtSecret string, subject string) (string, error) {
+// tokenLifetime is how long a type of token lasts by default and at most.
+type tokenLifetime struct {
+	Default time.Duration
+	Max     time.Duration
+}
+
+var (
+	defaultAccessLifetime = tokenLifetime{Default: time.Hour, Max: 24 * time.Hour}
+	// Each refresh issues a new refresh token, so a session lasts this
+	// long after it was last used
+	defaultRefreshLifetime = tokenLifetime{Default: 60 * 24 * time.Hour, Max: 60 * 24 * time.Hour}
+)
+
+// clamp returns the lifetime for a token a client asked to last requested,
+// 0 for the default. Longer requests get the max.
+func (lifetime tokenLifetime) clamp(requested time.Duration) time.Duration {
+	if requested <= 0 {
+		return lifetime.Default
+	}
+	return min(requested, lifetime.Max)
+}
+
+func generateAccessToken(keys *keyring, subject string, expiresAt time.Time) (string, error) {
 	issuedAt := time.Now()
-	expiresAt := time.Now().Add(time.Minute * 60)
 
 	claims := jwt.RegisteredClaims{
 		Issuer:    "chirpy-access",
@@ -23,8 +46,7 @@ func generateAccessToken(jwtSecret string, subject string) (string, error) {
 		Subject:   subject,
 	}
 
-	tokenSet := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	token, err := tokenSet.SignedString([]byte(jwtSecret))
+	token, err := keys.sign(claims)
 
 	if err != nil {
 		return "", errors.New("unauthorized")
@@ -33,19 +55,26 @@ func generateAccessToken(jwtSecret string, subject string) (string, error) {
 	return token, nil
 }
 
-func generateRefreshToken(jwtSecret string, subject string) (string, error) {
+func generateRefreshToken(keys *keyring, subject string, expiresAt time.Time) (string, error) {
 	issuedAt := time.Now()
-	expiresAt := time.Now().Add(time.Minute * 86400)
+
+	// Refresh tokens are rotated on every use, so two can be issued to the
+	// same user within a second. The ID keeps them distinct.
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", errors.New("unauthorized")
+	}
 
 	claims := jwt.RegisteredClaims{
+		ID:        hex.EncodeToString(id),
 		Issuer:    "chirpy-refresh",
 		IssuedAt:  jwt.NewNumericDate(issuedAt),
 		ExpiresAt: jwt.NewNumericDate(expiresAt),
 		Subject:   subject,
 	}
 
-	tokenSet := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	token, err := tokenSet.SignedString([]byte(jwtSecret))
+	token, err := keys.sign(claims)
 
 	if err != nil {
 		return "", errors.New("unauthorized")
@@ -54,60 +83,66 @@ func generateRefreshToken(jwtSecret string, subject string) (string, error) {
 	return token, nil
 }
 
-func authenticate(jwtSecret string, auth string) (int, error) {
-	// Split 'Bearer ' from token
-	splitAuth := strings.Split(auth, " ")
-	if len(splitAuth) != 2 {
-		return 0, errors.New("unauthorized")
-	}
-
-	token := splitAuth[1]
-	claims := jwt.RegisteredClaims{}
-	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(jwtSecret), nil
-	})
+func authenticateAccess(keys *keyring, auth string) (int, error) {
+	claims, err := parseToken(keys, auth, "chirpy-access")
 	if err != nil {
-		return 0, errors.New("unauthorized")
+		return 0, err
 	}
 
-	userId, err := strconv.Atoi(claims.Subject)
+	return strconv.Atoi(claims.Subject)
+}
+
+// authenticate checks the access token in auth, and that the account it was
+// issued to hasn't since been deleted.
+func (cfg *apiConfig) authenticate(auth string) (int, error) {
+	userId, err := authenticateAccess(cfg.keys, auth)
 	if err != nil {
-		return 0, errors.New("unauthorized")
+		return 0, err
 	}
 
-	if claims.Issuer != "chirpy-access" {
+	user, err := cfg.db.ReadUser(userId)
+	if err != nil || user.DeletedAt != nil {
 		return 0, errors.New("unauthorized")
 	}
 
 	return userId, nil
 }
 
-func authenticateRefresh(jwtSecret string, auth string) (int, error) {
+func authenticateRefresh(keys *keyring, auth string) (int, error) {
+	claims, err := parseToken(keys, auth, "chirpy-refresh")
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(claims.Subject)
+}
+
+// parseToken verifies the bearer token in auth was issued by issuer for a
+// user and returns its claims.
+func parseToken(keys *keyring, auth string, issuer string) (jwt.RegisteredClaims, error) {
 	// Split 'Bearer ' from token
 	splitAuth := strings.Split(auth, " ")
 	if len(splitAuth) != 2 {
-		return 0, errors.New("unauthorized")
+		return jwt.RegisteredClaims{}, errors.New("unauthorized")
 	}
 
 	token := splitAuth[1]
 	claims := jwt.RegisteredClaims{}
-	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(jwtSecret), nil
-	})
+	_, err := jwt.ParseWithClaims(token, &claims, keys.keyFunc)
 	if err != nil {
-		return 0, errors.New("unauthorized")
+		return jwt.RegisteredClaims{}, errors.New("unauthorized")
 	}
 
-	userId, err := strconv.Atoi(claims.Subject)
+	_, err = strconv.Atoi(claims.Subject)
 	if err != nil {
-		return 0, errors.New("unauthorized")
+		return jwt.RegisteredClaims{}, errors.New("unauthorized")
 	}
 
-	if claims.Issuer != "chirpy-refresh" {
-		return 0, errors.New("unauthorized")
+	if claims.Issuer != issuer {
+		return jwt.RegisteredClaims{}, errors.New("unauthorized")
 	}
 
-	return userId, nil
+	return claims, nil
 }
 
 func authenticatePolka(apiKey string, auth string) error {
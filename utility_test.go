@@ -1,6 +1,19 @@
 package main
 
-import "testing"
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/honesea/go-chirpy/internal/database"
+)
 
 func TestProfanityFilter(t *testing.T) {
 	message := "I really need a kerfuffle with sharbert to go to bed sooner, Fornax !"
@@ -12,3 +25,97 @@ func TestProfanityFilter(t *testing.T) {
 		t.Errorf("Expected '%v' but got '%v'", expected, actual)
 	}
 }
+
+func writeKey(t *testing.T, dir string, kid string, key any, public bool) {
+	t.Helper()
+
+	blockType := "PRIVATE KEY"
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if public {
+		blockType = "PUBLIC KEY"
+		der, err = x509.MarshalPKIXPublicKey(key)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	err = os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	dir := t.TempDir()
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey(t, dir, "old", oldKey, false)
+
+	keys, err := loadKeyring(dir, "old")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	oldToken, _ := generateAccessToken(keys, "1", time.Now().Add(time.Hour))
+	legacyToken, _ := generateAccessToken(newHMACKeyring("secret"), "1", time.Now().Add(time.Hour))
+
+	// Rotate to an RSA key, keeping only the public half of the old one
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	writeKey(t, dir, "new", newKey, false)
+	writeKey(t, dir, "old", oldKey.Public(), true)
+
+	keys, err = loadKeyring(dir, "new")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	newToken, _ := generateAccessToken(keys, "1", time.Now().Add(time.Hour))
+
+	parsed, _, _ := jwt.NewParser().ParseUnverified(newToken, &jwt.RegisteredClaims{})
+	if parsed.Header["kid"] != "new" || parsed.Header["alg"] != "RS256" {
+		t.Errorf("Expected the new key to sign but got %v", parsed.Header)
+	}
+
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if userID, err := authenticateAccess(keys, "Bearer "+token); err != nil || userID != 1 {
+			t.Errorf("Expected the %v token to verify but got %v (%v)", name, userID, err)
+		}
+	}
+
+	// The shared secret is no longer trusted once keys are set up
+	if _, err := authenticateAccess(keys, "Bearer "+legacyToken); err == nil {
+		t.Errorf("Expected an HS256 token without a kid to be rejected")
+	}
+
+	// An HS256 token naming a public key must not verify with it
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Issuer: "chirpy-access", Subject: "1"})
+	forged.Header["kid"] = "new"
+	forgedToken, _ := forged.SignedString([]byte("secret"))
+	if _, err := authenticateAccess(keys, "Bearer "+forgedToken); err == nil {
+		t.Errorf("Expected a token with the wrong algorithm for its key to be rejected")
+	}
+
+	if _, err := loadKeyring(dir, "old"); err == nil {
+		t.Errorf("Expected a public key to be refused for signing")
+	}
+
+	jwks := keys.jwks()
+	if len(jwks) != 2 || jwks[0].Kid != "new" || jwks[0].Kty != "RSA" || jwks[0].E != "AQAB" ||
+		jwks[1].Kid != "old" || jwks[1].Kty != "OKP" || jwks[1].X == "" {
+		t.Errorf("Expected both public keys to be published but got %+v", jwks)
+	}
+}
+
+func TestAuthenticateDeletedUser(t *testing.T) {
+	db := database.NewMemoryDB()
+	user, _ := db.CreateUser("alice@example.com", "hunter2")
+	cfg := apiConfig{db: db, keys: newHMACKeyring("secret")}
+
+	token, _ := generateAccessToken(cfg.keys, "1", time.Now().Add(time.Hour))
+	if userID, err := cfg.authenticate("Bearer " + token); err != nil || userID != user.ID {
+		t.Fatalf("Expected the token to authenticate %v but got %v (%v)", user.ID, userID, err)
+	}
+
+	db.DeleteUser(user.ID)
+	if _, err := cfg.authenticate("Bearer " + token); err == nil {
+		t.Errorf("Expected a deleted user's access token to be rejected")
+	}
+}